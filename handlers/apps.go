@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+const (
+	defaultRows = 30
+	defaultCols = 120
+)
+
+// AppManifest describes one runnable app: what it is, which arguments it
+// accepts and how it is started.
+type AppManifest struct {
+	Description string         `yaml:"description"`
+	Tags        []string       `yaml:"tags"`
+	Args        ArgPolicy      `yaml:"args"`
+	Size        PtySize        `yaml:"size"`
+	WorkingDir  string         `yaml:"working_dir"` // relative paths are inside AppsDirectory
+	Env         EnvPolicy      `yaml:"env"`
+	Timeouts    AppTimeouts    `yaml:"timeouts"`
+	Limits      ResourceLimits `yaml:"limits"`
+	Sandbox     SandboxConfig  `yaml:"sandbox"`
+	Record      bool           `yaml:"record"`
+	RecordInput bool           `yaml:"record_input"` // also record keystrokes, which may include anything a visitor types
+	StderrTail  bool           `yaml:"stderr_tail"`  // pipe stderr so its tail is reported at exit; stderr is then not a terminal
+	SHA256      string         `yaml:"sha256"`       // hex digest the executable must match
+	Signature   string         `yaml:"signature"`    // base64 ed25519 signature of the executable's SHA-256 digest
+	digest      string         // digest pinned when the app was registered
+}
+
+// ArgPolicy limits the arguments a visitor may pass to an app. By default
+// no arguments are accepted. With MaxCount set, each argument must be in
+// Allow or fully match Pattern; when neither is given any value is accepted.
+type ArgPolicy struct {
+	MaxCount int      `yaml:"max_count" json:"max_count"`
+	Allow    []string `yaml:"allow" json:"allow,omitempty"`
+	Pattern  string   `yaml:"pattern" json:"pattern,omitempty"`
+}
+
+// PtySize is the terminal size an app starts with when the client has not
+// reported its own. Zero values default to 30x120.
+type PtySize struct {
+	Rows int `yaml:"rows" json:"rows"`
+	Cols int `yaml:"cols" json:"cols"`
+}
+
+// AppInfo is the public view of an app served by /apps.
+type AppInfo struct {
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Args        ArgPolicy `json:"args"`
+	Size        PtySize   `json:"size"`
+}
+
+func (p ArgPolicy) check(args []string) error {
+	if len(args) > p.MaxCount {
+		if p.MaxCount == 0 {
+			return errors.New("this app does not take arguments")
+		}
+		return fmt.Errorf("at most %d arguments allowed, got %d", p.MaxCount, len(args))
+	}
+
+	if len(p.Allow) == 0 && p.Pattern == "" {
+		return nil
+	}
+
+	var pattern *regexp.Regexp
+	if p.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(`^(?:` + p.Pattern + `)$`); err != nil {
+			return fmt.Errorf("invalid argument pattern: %w", err)
+		}
+	}
+	for _, arg := range args {
+		if slices.Contains(p.Allow, arg) || (pattern != nil && pattern.MatchString(arg)) {
+			continue
+		}
+		return fmt.Errorf("argument %q is not allowed", arg)
+	}
+	return nil
+}
+
+func (p ArgPolicy) validate() error {
+	if p.MaxCount < 0 {
+		return errors.New("max_count must not be negative")
+	}
+	if p.Pattern != "" {
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s PtySize) withDefaults() PtySize {
+	if s.Rows <= 0 {
+		s.Rows = defaultRows
+	}
+	if s.Cols <= 0 {
+		s.Cols = defaultCols
+	}
+	return s
+}
+
+func (m AppManifest) info() AppInfo {
+	tags := m.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return AppInfo{
+		Description: m.Description,
+		Tags:        tags,
+		Args:        m.Args,
+		Size:        m.Size.withDefaults(),
+	}
+}
+
+// app returns the manifest of a registered app and the path to its
+// executable, read at once so a reload cannot mix two versions of the config.
+func (c *TerminalConfig) app(name string) (AppManifest, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	manifest, ok := c.Apps[name]
+	if !ok {
+		return AppManifest{}, "", false
+	}
+	if manifest.WorkingDir != "" && !filepath.IsAbs(manifest.WorkingDir) {
+		manifest.WorkingDir = filepath.Join(c.AppsDirectory, manifest.WorkingDir)
+	}
+	return manifest, filepath.Join(c.AppsDirectory, name), true
+}
+
+// commandNames lists what can be typed at the prompt: the built-in commands
+// and the registered apps.
+func (c *TerminalConfig) commandNames() []string {
+	names, _, _ := c.apps()
+	for name := range builtinCommands {
+		names = append(names, name)
+	}
+	return names
+}
+
+// apps returns the registered apps sorted by name.
+func (c *TerminalConfig) apps() ([]string, map[string]AppManifest, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.Apps))
+	for name := range c.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The map is replaced, never modified, on reload, so callers may read it
+	// without holding the lock.
+	return names, c.Apps, c.AppsDirectory
+}
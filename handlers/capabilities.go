@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/creack/pty"
+)
+
+// maxTerminalCells bounds the rows and cols a client may report.
+const maxTerminalCells = 1000
+
+var (
+	termPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_-]{0,63}$`)
+	localePattern = regexp.MustCompile(`^(C|POSIX|[A-Za-z]{2,3}(_[A-Za-z]{2})?)(\.[A-Za-z0-9-]{1,20})?(@[A-Za-z0-9]{1,20})?$`)
+)
+
+// clientTerminal is what the client reported about its terminal, in its
+// hello message and later resizes. Zero values were not reported.
+type clientTerminal struct {
+	Rows        int
+	Cols        int
+	PixelWidth  int
+	PixelHeight int
+	ColorDepth  int // bits per color: 1, 4, 8 or 24
+	Term        string
+	Locale      string
+}
+
+func (t clientTerminal) validate() error {
+	if (t.Rows == 0) != (t.Cols == 0) {
+		return errors.New("rows and cols must be reported together")
+	}
+	if t.Rows < 0 || t.Cols < 0 || t.Rows > maxTerminalCells || t.Cols > maxTerminalCells {
+		return fmt.Errorf("rows and cols must be between 1 and %d", maxTerminalCells)
+	}
+	if t.PixelWidth < 0 || t.PixelHeight < 0 || t.PixelWidth > math.MaxUint16 || t.PixelHeight > math.MaxUint16 {
+		return fmt.Errorf("pixel_width and pixel_height must be between 0 and %d", math.MaxUint16)
+	}
+	switch t.ColorDepth {
+	case 0, 1, 4, 8, 24:
+	default:
+		return fmt.Errorf("color_depth must be 1, 4, 8 or 24, got %d", t.ColorDepth)
+	}
+	if t.Term != "" && !termPattern.MatchString(t.Term) {
+		return fmt.Errorf("invalid term %q", t.Term)
+	}
+	if t.Locale != "" && !localePattern.MatchString(t.Locale) {
+		return fmt.Errorf("invalid locale %q", t.Locale)
+	}
+	return nil
+}
+
+// winsize is the size an app starts with: the client's if it reported one,
+// otherwise the app's configured size.
+func (t clientTerminal) winsize(fallback PtySize) *pty.Winsize {
+	if t.Rows == 0 {
+		fallback = fallback.withDefaults()
+		return &pty.Winsize{Rows: uint16(fallback.Rows), Cols: uint16(fallback.Cols)}
+	}
+	return &pty.Winsize{
+		Rows: uint16(t.Rows),
+		Cols: uint16(t.Cols),
+		X:    uint16(t.PixelWidth),
+		Y:    uint16(t.PixelHeight),
+	}
+}
+
+// applyEnv replaces the terminal defaults in env with what the client
+// reported. Without a TERM of its own, the client's color depth picks one.
+func (t clientTerminal) applyEnv(env map[string]string) {
+	switch t.ColorDepth {
+	case 1:
+		env["TERM"] = "xterm"
+		env["NO_COLOR"] = "1"
+		delete(env, "COLORTERM")
+	case 4:
+		env["TERM"] = "xterm"
+		delete(env, "COLORTERM")
+	case 8:
+		delete(env, "COLORTERM")
+	}
+	if t.Term != "" {
+		env["TERM"] = t.Term
+	}
+	if t.Locale != "" {
+		// The client's locale may not be installed here; LC_CTYPE keeps
+		// character handling UTF-8 either way.
+		env["LANG"] = t.Locale
+		env["LC_CTYPE"] = "C.UTF-8"
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitCommand splits a command line into words the way a POSIX shell does,
+// minus expansions. Single quotes keep everything literally. Inside double
+// quotes a backslash only escapes $, `, " and \. Outside quotes a backslash
+// escapes any character.
+func splitCommand(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("line ends with a backslash")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+			inWord = true
+
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\", runes[i+1]) {
+					i++
+				}
+				word.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "", want: nil},
+		{line: "  \t ", want: nil},
+		{line: "search black lotus", want: []string{"search", "black", "lotus"}},
+		{line: " search \t lotus ", want: []string{"search", "lotus"}},
+		{line: `search "black lotus"`, want: []string{"search", "black lotus"}},
+		{line: `search 'black lotus'`, want: []string{"search", "black lotus"}},
+		{line: `search bl"ack lo"tus`, want: []string{"search", "black lotus"}},
+		{line: `a "" b`, want: []string{"a", "", "b"}},
+		{line: `a '' b`, want: []string{"a", "", "b"}},
+		{line: `""`, want: []string{""}},
+		{line: `a""`, want: []string{"a"}},
+		{line: `black\ lotus`, want: []string{"black lotus"}},
+		{line: `\"quoted\"`, want: []string{`"quoted"`}},
+		{line: `\a\\b`, want: []string{`a\b`}},
+		{line: `"\$HOME \" \\ \n"`, want: []string{`$HOME " \ \n`}},
+		{line: "\"\\`date\\`\"", want: []string{"`date`"}},
+		{line: `'\n $HOME "x"'`, want: []string{`\n $HOME "x"`}},
+		{line: `"it's"`, want: []string{"it's"}},
+		{line: `'say "hi"'`, want: []string{`say "hi"`}},
+		{line: "carte blanché", want: []string{"carte", "blanché"}},
+		{line: `search "black lotus`, wantErr: true},
+		{line: `search 'black lotus`, wantErr: true},
+		{line: `"\"`, wantErr: true},
+		{line: `'`, wantErr: true},
+		{line: `search lotus\`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitCommand(%q) = %q, want an error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitCommand(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the YAML form of TerminalConfig. Each block under defaults
+// applies to every app that does not set that block itself.
+type FileConfig struct {
+	AppsDirectory     string                 `yaml:"apps_directory"`
+	DiscoverApps      bool                   `yaml:"discover_apps"`
+	AllowedOrigins    []string               `yaml:"allowed_origins"`
+	MaxConcurrent     int                    `yaml:"max_concurrent"`
+	MaxQueueLength    int                    `yaml:"max_queue_length"`
+	ResumeGracePeriod time.Duration          `yaml:"resume_grace_period"`
+	ScrollbackSize    int                    `yaml:"scrollback_size"`
+	CgroupParent      string                 `yaml:"cgroup_parent"`
+	ShutdownTimeout   time.Duration          `yaml:"shutdown_timeout"`
+	SigningKeys       []string               `yaml:"signing_keys"`
+	RequireSignatures bool                   `yaml:"require_signatures"`
+	Recordings        RecordingsConfig       `yaml:"recordings"`
+	Output            OutputConfig           `yaml:"output"`
+	WebSocket         WebSocketConfig        `yaml:"websocket"`
+	RateLimits        RateLimits             `yaml:"rate_limits"`
+	Defaults          AppDefaults            `yaml:"defaults"`
+	Apps              map[string]AppManifest `yaml:"apps"`
+}
+
+type RecordingsConfig struct {
+	Directory string `yaml:"directory"`
+	Max       int    `yaml:"max"`
+}
+
+type AppDefaults struct {
+	Env      EnvPolicy      `yaml:"env"`
+	Timeouts AppTimeouts    `yaml:"timeouts"`
+	Limits   ResourceLimits `yaml:"limits"`
+	Sandbox  SandboxConfig  `yaml:"sandbox"`
+}
+
+// Environment variables that override the config file.
+const (
+	envAppsDirectory       = "TERMINAL_APPS_DIRECTORY"
+	envAllowedOrigins      = "TERMINAL_ALLOWED_ORIGINS"
+	envMaxConcurrent       = "TERMINAL_MAX_CONCURRENT"
+	envMaxQueueLength      = "TERMINAL_MAX_QUEUE_LENGTH"
+	envResumeGracePeriod   = "TERMINAL_RESUME_GRACE_PERIOD"
+	envRecordingsDirectory = "TERMINAL_RECORDINGS_DIRECTORY"
+)
+
+const defaultShutdownTimeout = 20 * time.Second
+
+// builtinCommands cannot be used as app names since the prompt handles them.
+var builtinCommands = map[string]bool{"help": true, "list": true, "clear": true, "history": true}
+
+// LoadConfig reads a config file, applies environment overrides and
+// validates the result.
+func LoadConfig(path string) (*TerminalConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file FileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	// Which blocks each app set itself, so the rest can come from defaults.
+	var present struct {
+		Apps map[string]map[string]any `yaml:"apps"`
+	}
+	if err := yaml.Unmarshal(data, &present); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for name, app := range file.Apps {
+		file.Apps[name] = file.Defaults.apply(app, present.Apps[name])
+	}
+
+	if err := file.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := file.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	if file.DiscoverApps {
+		if file.Apps == nil {
+			file.Apps = make(map[string]AppManifest)
+		}
+		for name, manifest := range discoverApps(file.AppsDirectory, file.Defaults, file.Apps) {
+			file.Apps[name] = manifest
+		}
+	}
+
+	config := file.terminalConfig()
+	config.SigningKeys, err = parseSigningKeys(file.SigningKeys)
+	if err != nil {
+		return nil, err
+	}
+	config.Apps = verifyApps(config.AppsDirectory, config.Apps, config.SigningKeys, config.RequireSignatures)
+	config.pinApps(config.Apps)
+	if len(config.Apps) == 0 {
+		slog.Warn("No apps are registered")
+	}
+	return config, nil
+}
+
+func (f *FileConfig) applyEnv() error {
+	if v, ok := os.LookupEnv(envAppsDirectory); ok {
+		f.AppsDirectory = v
+	}
+	if v, ok := os.LookupEnv(envAllowedOrigins); ok {
+		f.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				f.AllowedOrigins = append(f.AllowedOrigins, origin)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv(envMaxConcurrent); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envMaxConcurrent, err)
+		}
+		f.MaxConcurrent = n
+	}
+	if v, ok := os.LookupEnv(envMaxQueueLength); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envMaxQueueLength, err)
+		}
+		f.MaxQueueLength = n
+	}
+	if v, ok := os.LookupEnv(envResumeGracePeriod); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envResumeGracePeriod, err)
+		}
+		f.ResumeGracePeriod = d
+	}
+	if v, ok := os.LookupEnv(envRecordingsDirectory); ok {
+		f.Recordings.Directory = v
+	}
+	return nil
+}
+
+func (f *FileConfig) validate() error {
+	var errs []error
+
+	if f.AppsDirectory == "" {
+		errs = append(errs, errors.New("apps_directory is required"))
+	}
+	if len(f.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("allowed_origins must list at least one origin"))
+	}
+	for _, origin := range f.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("allowed_origins: %q is not an origin like https://example.com", origin))
+		}
+	}
+	if f.MaxConcurrent < 1 {
+		errs = append(errs, errors.New("max_concurrent must be at least 1"))
+	}
+	if f.MaxQueueLength < 0 {
+		errs = append(errs, errors.New("max_queue_length must not be negative"))
+	}
+	if f.ResumeGracePeriod < 0 {
+		errs = append(errs, errors.New("resume_grace_period must not be negative"))
+	}
+	if f.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout must not be negative"))
+	}
+	if f.ScrollbackSize < 0 {
+		errs = append(errs, errors.New("scrollback_size must not be negative"))
+	}
+	if f.Recordings.Max < 0 {
+		errs = append(errs, errors.New("recordings.max must not be negative"))
+	}
+	if p := f.Output.Policy; p != "" && p != OutputPause && p != OutputDrop {
+		errs = append(errs, fmt.Errorf("output.policy: unknown policy %q", p))
+	}
+	if _, err := parseSigningKeys(f.SigningKeys); err != nil {
+		errs = append(errs, err)
+	}
+	if f.RequireSignatures && len(f.SigningKeys) == 0 {
+		errs = append(errs, errors.New("require_signatures needs at least one of signing_keys"))
+	}
+	if f.Output.CoalesceWindow < 0 || f.Output.WriteTimeout < 0 || f.Output.MaxBuffered < 0 {
+		errs = append(errs, errors.New("output settings must not be negative"))
+	}
+	if w := f.WebSocket; w.PingInterval < 0 || w.PongTimeout < 0 || w.MaxMessageSize < 0 {
+		errs = append(errs, errors.New("websocket settings must not be negative"))
+	}
+	if err := f.RateLimits.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limits: %w", err))
+	}
+
+	for name, app := range f.Apps {
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+			errs = append(errs, fmt.Errorf("apps: %q is not a valid app name", name))
+		}
+		if builtinCommands[name] {
+			errs = append(errs, fmt.Errorf("apps: %q is a built-in command", name))
+		}
+		if err := app.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("apps.%s: %w", name, err))
+		}
+		if err := app.Sandbox.checkVisible(f.AppsDirectory, app.WorkingDir); err != nil {
+			errs = append(errs, fmt.Errorf("apps.%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d AppDefaults) apply(app AppManifest, present map[string]any) AppManifest {
+	if _, ok := present["env"]; !ok {
+		app.Env = d.Env
+	}
+	if _, ok := present["timeouts"]; !ok {
+		app.Timeouts = d.Timeouts
+	}
+	if _, ok := present["limits"]; !ok {
+		app.Limits = d.Limits
+	}
+	if _, ok := present["sandbox"]; !ok {
+		app.Sandbox = d.Sandbox
+	}
+	return app
+}
+
+// checkNotWeakened reports what a sidecar manifest loosens compared to the
+// defaults. Anyone who can write to the apps directory can write a sidecar,
+// so discovered apps may tighten the sandbox and environment but not relax
+// them; that takes an entry in config.yaml.
+func (d AppDefaults) checkNotWeakened(m AppManifest) error {
+	var errs []error
+	if d.Sandbox.Enabled && !m.Sandbox.Enabled {
+		errs = append(errs, errors.New("sandbox.enabled is off"))
+	}
+	if d.Sandbox.Enabled && m.Sandbox.Network == NetworkHost && d.Sandbox.Network != NetworkHost {
+		errs = append(errs, errors.New("sandbox.network is host"))
+	}
+	for _, name := range m.Env.Inherit {
+		if !slices.Contains(d.Env.Inherit, name) {
+			errs = append(errs, fmt.Errorf("env.inherit adds %s", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m AppManifest) validate() error {
+	var errs []error
+	if err := m.Args.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("args: %w", err))
+	}
+	if m.Size.Rows < 0 || m.Size.Cols < 0 {
+		errs = append(errs, errors.New("size must not be negative"))
+	}
+	if n := m.Sandbox.Network; n != "" && n != NetworkNone && n != NetworkHost {
+		errs = append(errs, fmt.Errorf("sandbox.network: unknown policy %q", n))
+	}
+	if m.Sandbox.Home != "" && !filepath.IsAbs(m.Sandbox.Home) {
+		errs = append(errs, errors.New("sandbox.home must be an absolute path"))
+	}
+	if m.SHA256 != "" {
+		if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != sha256.Size {
+			errs = append(errs, errors.New("sha256 must be 64 hex digits"))
+		}
+	}
+	if m.Signature != "" {
+		if sig, err := base64.StdEncoding.DecodeString(m.Signature); err != nil || len(sig) != ed25519.SignatureSize {
+			errs = append(errs, errors.New("signature must be a base64 ed25519 signature"))
+		}
+	}
+	if t := m.Timeouts; t.Idle < 0 || t.MaxRuntime < 0 || t.Warning < 0 {
+		errs = append(errs, errors.New("timeouts must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (f *FileConfig) terminalConfig() *TerminalConfig {
+	c := &TerminalConfig{
+		AppsDirectory:       f.AppsDirectory,
+		DiscoverApps:        f.DiscoverApps,
+		Apps:                f.Apps,
+		AllowedOrigins:      make(map[string]bool),
+		MaxConcurrent:       f.MaxConcurrent,
+		MaxQueueLength:      f.MaxQueueLength,
+		ResumeGracePeriod:   f.ResumeGracePeriod,
+		ScrollbackSize:      f.ScrollbackSize,
+		RecordingsDirectory: f.Recordings.Directory,
+		MaxRecordings:       f.Recordings.Max,
+		CgroupParent:        f.CgroupParent,
+		ShutdownTimeout:     f.ShutdownTimeout,
+		RequireSignatures:   f.RequireSignatures,
+		Output:              f.Output,
+		WebSocket:           f.WebSocket,
+		RateLimits:          f.RateLimits,
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	for _, origin := range f.AllowedOrigins {
+		c.AllowedOrigins[strings.TrimSuffix(origin, "/")] = true
+	}
+	return c
+}
+
+// Reload replaces the settings of a running config with those of next.
+// Sessions keep running; apps already started keep the settings they were
+// launched with.
+func (c *TerminalConfig) Reload(next *TerminalConfig) {
+	c.mu.Lock()
+	if next.CgroupParent != c.CgroupParent {
+		slog.Warn("cgroup_parent changed, restart the server to apply it", "cgroup_parent", next.CgroupParent)
+	}
+	if next.ShutdownTimeout != c.ShutdownTimeout {
+		slog.Warn("shutdown_timeout changed, restart the server to apply it", "shutdown_timeout", next.ShutdownTimeout)
+	}
+
+	c.pinApps(next.Apps)
+	c.AppsDirectory = next.AppsDirectory
+	c.DiscoverApps = next.DiscoverApps
+	c.Apps = next.Apps
+	c.AllowedOrigins = next.AllowedOrigins
+	c.MaxConcurrent = next.MaxConcurrent
+	c.MaxQueueLength = next.MaxQueueLength
+	c.ResumeGracePeriod = next.ResumeGracePeriod
+	c.ScrollbackSize = next.ScrollbackSize
+	c.RecordingsDirectory = next.RecordingsDirectory
+	c.MaxRecordings = next.MaxRecordings
+	c.Output = next.Output
+	c.WebSocket = next.WebSocket
+	c.RateLimits = next.RateLimits
+	c.SigningKeys = next.SigningKeys
+	c.RequireSignatures = next.RequireSignatures
+	c.mu.Unlock()
+
+	// More slots may have opened up for launches that are waiting.
+	c.startWaiting()
+}
+
+// WatchConfig reloads the config file on SIGHUP and whenever it, or with
+// DiscoverApps the apps directory, changes on disk. A file that fails to load
+// or validate leaves the current config in place.
+func WatchConfig(path string, config *TerminalConfig, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := config.stamp(path)
+	for {
+		select {
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "config", path)
+		case <-ticker.C:
+			stamp := config.stamp(path)
+			if stamp == last {
+				continue
+			}
+			slog.Info("Config or apps directory changed, reloading", "config", path)
+		}
+		last = config.stamp(path)
+
+		next, err := LoadConfig(path)
+		if err != nil {
+			slog.Error("Reloading config failed, keeping the current one", "config", path, "error", err)
+			continue
+		}
+		config.Reload(next)
+		slog.Info("Config reloaded", "apps", GetAppsList(config))
+	}
+}
+
+func (c *TerminalConfig) stamp(path string) string {
+	stamp := ""
+	if info, err := os.Stat(path); err == nil {
+		stamp = fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	}
+
+	c.mu.Lock()
+	discover, dir := c.DiscoverApps, c.AppsDirectory
+	c.mu.Unlock()
+
+	if discover {
+		stamp += "|" + dirStamp(dir)
+	}
+	return stamp
+}
+
+// OriginAllowed reports whether browsers from origin may use the API. The
+// WebSocket upgrader and the CORS middleware both use it.
+func (c *TerminalConfig) OriginAllowed(origin string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.AllowedOrigins[origin]
+}
+
+func (c *TerminalConfig) recordings() (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.RecordingsDirectory, c.MaxRecordings
+}
+
+func (c *TerminalConfig) queueEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.MaxQueueLength > 0
+}
+
+func (c *TerminalConfig) resumeGracePeriod() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ResumeGracePeriod
+}
@@ -3,12 +3,13 @@ package handlers
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/smtp"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -26,21 +27,47 @@ type ContactResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
-func HandleContact(c echo.Context) error {
+// HandleContact sends contact form submissions by email. Each one costs an
+// SMTP send, so submissions have a budget per client IP and per Origin.
+func HandleContact(config *TerminalConfig) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		metrics := config.Metrics
+		metrics.contactReceived()
+
+		if delay, limit := config.limitRequest(endpointContact, c.Request()); delay > 0 {
+			metrics.contactFailed("rate_limited")
+			slog.Info("Contact submission rate limited",
+				"request_id", c.Response().Header().Get(echo.HeaderXRequestID),
+				"remote_ip", c.RealIP(),
+				"limit", limit,
+				"retry_after", delay)
+			c.Response().Header().Set("Retry-After", retryAfter(delay))
+			return c.JSON(http.StatusTooManyRequests, ContactResponse{
+				Error: "Too many messages, please try again later",
+			})
+		}
+		return handleContact(c, metrics)
+	}
+}
+
+func handleContact(c echo.Context, metrics *Metrics) error {
 	var req ContactRequest
 	if err := c.Bind(&req); err != nil {
+		metrics.contactFailed("invalid_request")
 		return c.JSON(http.StatusBadRequest, ContactResponse{
 			Error: "Invalid request Body",
 		})
 	}
 
 	if req.Name == "" || req.Email == "" || req.Message == "" {
+		metrics.contactFailed("missing_fields")
 		return c.JSON(http.StatusBadRequest, ContactResponse{
 			Error: "Missing Required Fields",
 		})
 	}
 
 	if !isValidEmail(req.Email) {
+		metrics.contactFailed("invalid_email")
 		return c.JSON(http.StatusBadRequest, ContactResponse{
 			Error: "Invalid email address",
 		})
@@ -51,8 +78,14 @@ func HandleContact(c echo.Context) error {
 	req.Subject = strings.TrimSpace(req.Subject)
 	req.Message = strings.TrimSpace(req.Message)
 
-	if err := sendEmail(req); err != nil {
-		log.Printf("Error sending email: %v", err)
+	start := time.Now()
+	err := sendEmail(req)
+	metrics.smtpFinished(time.Since(start))
+	if err != nil {
+		metrics.contactFailed("smtp")
+		slog.Error("Sending contact email failed",
+			"request_id", c.Response().Header().Get(echo.HeaderXRequestID),
+			"error", err)
 		return c.JSON(http.StatusInternalServerError, ContactResponse{
 			Error: "Failed to send message",
 		})
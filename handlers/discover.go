@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestExt is the extension of the sidecar manifest that registers the
+// executable of the same name, e.g. kanban.yaml for kanban.
+const manifestExt = ".yaml"
+
+// discoverApps registers every executable in dir that has a valid sidecar
+// manifest, except those already defined in the config file. Anything that
+// does not qualify is logged with the reason.
+func discoverApps(dir string, defaults AppDefaults, defined map[string]AppManifest) map[string]AppManifest {
+	apps := make(map[string]AppManifest)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Scanning apps directory failed", "dir", dir, "error", err)
+		return apps
+	}
+
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		files[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasSuffix(name, manifestExt) {
+			if !files[strings.TrimSuffix(name, manifestExt)] {
+				slog.Warn("Skipping manifest without an executable", "manifest", name, "app", strings.TrimSuffix(name, manifestExt))
+			}
+			continue
+		}
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := defined[name]; ok {
+			if files[name+manifestExt] {
+				slog.Warn("Ignoring discovered manifest, the app is defined in the config file", "app", name)
+			}
+			continue
+		}
+
+		manifest, err := loadDiscoveredApp(dir, name, defaults)
+		if err != nil {
+			slog.Warn("Skipping app", "app", name, "reason", err)
+			continue
+		}
+		apps[name] = manifest
+	}
+	return apps
+}
+
+func loadDiscoveredApp(dir, name string, defaults AppDefaults) (AppManifest, error) {
+	if builtinCommands[name] {
+		return AppManifest{}, errors.New("name is a built-in command")
+	}
+
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return AppManifest{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return AppManifest{}, errors.New("not a regular file")
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return AppManifest{}, errors.New("not executable")
+	}
+
+	data, err := os.ReadFile(path + manifestExt)
+	if os.IsNotExist(err) {
+		return AppManifest{}, fmt.Errorf("no %s%s manifest", name, manifestExt)
+	}
+	if err != nil {
+		return AppManifest{}, err
+	}
+
+	var manifest AppManifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&manifest); err != nil && err != io.EOF {
+		return AppManifest{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+	var present map[string]any
+	if err := yaml.Unmarshal(data, &present); err != nil {
+		return AppManifest{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+	manifest = defaults.apply(manifest, present)
+
+	if err := manifest.validate(); err != nil {
+		return AppManifest{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := defaults.checkNotWeakened(manifest); err != nil {
+		return AppManifest{}, fmt.Errorf("manifest weakens defaults: %w", err)
+	}
+	if err := manifest.Sandbox.checkVisible(dir, manifest.WorkingDir); err != nil {
+		return AppManifest{}, err
+	}
+
+	return manifest, nil
+}
+
+// dirStamp changes whenever a file in dir is added, removed or modified.
+func dirStamp(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	var stamps []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		stamps = append(stamps, fmt.Sprintf("%s:%d:%d:%o", entry.Name(), info.ModTime().UnixNano(), info.Size(), info.Mode()))
+	}
+	sort.Strings(stamps)
+	return strings.Join(stamps, "/")
+}
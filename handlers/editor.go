@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+const (
+	promptText = "\x1b[1;32m$\x1b[0m "
+	maxHistory = 100
+)
+
+// lineEditor edits the command line at the idle prompt. It works on runes,
+// so multi-byte input is never split, and understands the escape sequences
+// terminals send for arrow, Home, End and Delete keys.
+type lineEditor struct {
+	line    []rune
+	cursor  int
+	history []string
+	browse  int    // position in history while browsing, len(history) on a new line
+	draft   []rune // the new line, kept while browsing history
+	pending string // escape sequence cut off at the end of the previous input
+	lastCR  bool   // the previous key was \r, so a following \n is part of it
+
+	write     func(string)
+	submit    func(string) bool // runs a line; false stops the editor reading further input
+	interrupt func()
+	words     func() []string // candidates for completing the first word
+}
+
+func newLineEditor(write func(string), submit func(string) bool, interrupt func(), words func() []string) *lineEditor {
+	return &lineEditor{write: write, submit: submit, interrupt: interrupt, words: words}
+}
+
+// feed handles keyboard input. When a submitted line hands the terminal to
+// something else, e.g. a launched app, the input after that line is returned.
+func (e *lineEditor) feed(input string) string {
+	input = e.pending + input
+	e.pending = ""
+
+	for len(input) > 0 {
+		if input[0] == '\x1b' {
+			seq, ok := escapeSequence(input)
+			if !ok {
+				e.pending = input
+				return ""
+			}
+			e.handleEscape(seq)
+			input = input[len(seq):]
+			e.lastCR = false
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(input)
+		input = input[size:]
+
+		if r == '\n' && e.lastCR {
+			e.lastCR = false
+			continue
+		}
+		e.lastCR = r == '\r'
+
+		switch r {
+		case '\r', '\n':
+			if !e.enter() {
+				// The rest is not ours, but the \n of a \r\n still is.
+				if e.lastCR {
+					input = strings.TrimPrefix(input, "\n")
+					e.lastCR = false
+				}
+				return input
+			}
+		case 127, 8:
+			e.backspace()
+		case 1: // Ctrl+A
+			e.moveTo(0)
+		case 5: // Ctrl+E
+			e.moveTo(len(e.line))
+		case 21: // Ctrl+U
+			e.deleteRange(0, e.cursor)
+		case 11: // Ctrl+K
+			e.deleteRange(e.cursor, len(e.line))
+		case 23: // Ctrl+W
+			e.deleteRange(e.wordStart(), e.cursor)
+		case 3: // Ctrl+C
+			e.write("^C\r\n")
+			e.reset()
+			e.interrupt()
+			e.showPrompt()
+		case '\t':
+			e.complete()
+		default:
+			if unicode.IsPrint(r) {
+				e.insert(r)
+			}
+		}
+	}
+	return ""
+}
+
+// showPrompt draws the prompt and the line being edited on a fresh row.
+func (e *lineEditor) showPrompt() {
+	e.write(promptText + string(e.line) + cursorLeft(columns(e.line[e.cursor:])))
+}
+
+func (e *lineEditor) enter() bool {
+	line := string(e.line)
+	e.write("\r\n")
+	e.reset()
+
+	if strings.TrimSpace(line) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	e.browse = len(e.history)
+
+	if !e.submit(line) {
+		return false
+	}
+	e.showPrompt()
+	return true
+}
+
+func (e *lineEditor) reset() {
+	e.line = nil
+	e.cursor = 0
+	e.draft = nil
+	e.browse = len(e.history)
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line[:e.cursor], append([]rune{r}, e.line[e.cursor:]...)...)
+	e.cursor++
+	if e.cursor == len(e.line) {
+		e.write(string(r))
+		return
+	}
+	e.refresh()
+}
+
+func (e *lineEditor) backspace() {
+	if e.cursor > 0 {
+		e.deleteRange(e.cursor-1, e.cursor)
+	}
+}
+
+func (e *lineEditor) deleteRange(from, to int) {
+	if from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.cursor = from
+	e.refresh()
+}
+
+// wordStart is where Ctrl+W stops: the start of the word before the cursor,
+// skipping any spaces in between.
+func (e *lineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && e.line[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && e.line[i-1] != ' ' {
+		i--
+	}
+	return i
+}
+
+func (e *lineEditor) moveTo(pos int) {
+	pos = max(0, min(pos, len(e.line)))
+	switch {
+	case pos < e.cursor:
+		e.write(cursorLeft(columns(e.line[pos:e.cursor])))
+	case pos > e.cursor:
+		e.write(cursorRight(columns(e.line[e.cursor:pos])))
+	}
+	e.cursor = pos
+}
+
+func (e *lineEditor) handleEscape(seq string) {
+	switch seq {
+	case "\x1b[A", "\x1bOA":
+		e.historyUp()
+	case "\x1b[B", "\x1bOB":
+		e.historyDown()
+	case "\x1b[C", "\x1bOC":
+		e.moveTo(e.cursor + 1)
+	case "\x1b[D", "\x1bOD":
+		e.moveTo(e.cursor - 1)
+	case "\x1b[H", "\x1bOH", "\x1b[1~", "\x1b[7~":
+		e.moveTo(0)
+	case "\x1b[F", "\x1bOF", "\x1b[4~", "\x1b[8~":
+		e.moveTo(len(e.line))
+	case "\x1b[3~":
+		if e.cursor < len(e.line) {
+			e.deleteRange(e.cursor, e.cursor+1)
+		}
+	}
+}
+
+func (e *lineEditor) historyUp() {
+	if e.browse == 0 {
+		return
+	}
+	if e.browse == len(e.history) {
+		e.draft = e.line
+	}
+	e.browse--
+	e.setLine([]rune(e.history[e.browse]))
+}
+
+func (e *lineEditor) historyDown() {
+	if e.browse == len(e.history) {
+		return
+	}
+	e.browse++
+	if e.browse == len(e.history) {
+		e.setLine(e.draft)
+		return
+	}
+	e.setLine([]rune(e.history[e.browse]))
+}
+
+func (e *lineEditor) setLine(line []rune) {
+	e.line = append([]rune(nil), line...)
+	e.cursor = len(e.line)
+	e.refresh()
+}
+
+// complete completes the first word from the built-in commands and app
+// names. With several matches it extends the word as far as they agree and
+// lists them when there is nothing left to add.
+func (e *lineEditor) complete() {
+	prefix := string(e.line[:e.cursor])
+	if strings.ContainsRune(prefix, ' ') {
+		e.write("\a")
+		return
+	}
+
+	var matches []string
+	for _, word := range e.words() {
+		if strings.HasPrefix(word, prefix) {
+			matches = append(matches, word)
+		}
+	}
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		e.write("\a")
+	case 1:
+		e.insertString(strings.TrimPrefix(matches[0], prefix) + " ")
+	default:
+		if common := commonPrefix(matches); len(common) > len(prefix) {
+			e.insertString(strings.TrimPrefix(common, prefix))
+			return
+		}
+		e.write("\r\n" + strings.Join(matches, "  ") + "\r\n")
+		e.showPrompt()
+	}
+}
+
+func (e *lineEditor) insertString(s string) {
+	for _, r := range s {
+		e.insert(r)
+	}
+}
+
+// refresh redraws the prompt row after an edit in the middle of the line.
+func (e *lineEditor) refresh() {
+	e.write("\r" + promptText + string(e.line) + "\x1b[K" + cursorLeft(columns(e.line[e.cursor:])))
+}
+
+// escapeSequence returns the escape sequence at the start of s, or false
+// when s ends before the sequence does.
+func escapeSequence(s string) (string, bool) {
+	if len(s) < 2 {
+		return "", false
+	}
+	switch s[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes, then one final byte.
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return s[:i+1], true
+			}
+			if s[i] < 0x20 || s[i] > 0x3f {
+				return s[:i], true
+			}
+		}
+		return "", false
+	case 'O':
+		if len(s) < 3 {
+			return "", false
+		}
+		return s[:3], true
+	default:
+		return s[:1], true
+	}
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// columns is how many terminal cells runes take up: two for wide East
+// Asian characters, none for combining marks.
+func columns(runes []rune) int {
+	n := 0
+	for _, r := range runes {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me):
+		case width.LookupRune(r).Kind() == width.EastAsianWide, width.LookupRune(r).Kind() == width.EastAsianFullwidth:
+			n += 2
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func cursorLeft(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\x1b[%dD", n)
+}
+
+func cursorRight(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\x1b[%dC", n)
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLineEditorFeed(t *testing.T) {
+	const left, right = "\x1b[D", "\x1b[C"
+
+	tests := []struct {
+		name      string
+		inputs    []string
+		line      string
+		cursor    int
+		submitted []string
+		output    string // what the last input wrote, when it matters
+	}{
+		{name: "typing", inputs: []string{"abc"}, line: "abc", cursor: 3},
+		{name: "insert in the middle", inputs: []string{"ac", left, "b"}, line: "abc", cursor: 2},
+		{name: "multi-byte input", inputs: []string{"café日"}, line: "café日", cursor: 5},
+		{name: "control characters dropped", inputs: []string{"a\x00\x07b"}, line: "ab", cursor: 2},
+
+		{name: "escape split after ESC", inputs: []string{"abc\x1b", "[D"}, line: "abc", cursor: 2},
+		{name: "escape split after CSI", inputs: []string{"abc\x1b[", "D"}, line: "abc", cursor: 2},
+		{name: "escape split in parameters", inputs: []string{"abc", left + left + "\x1b[3", "~"}, line: "ac", cursor: 1},
+		{name: "escape split byte by byte", inputs: []string{"abc", "\x1b", "[", "H"}, line: "abc", cursor: 0},
+		{name: "SS3 escape split", inputs: []string{"abc\x1bO", "H"}, line: "abc", cursor: 0},
+		{name: "unknown escape ignored", inputs: []string{"ab\x1b[5~c"}, line: "abc", cursor: 3},
+		{name: "delete at the end", inputs: []string{"ab\x1b[3~"}, line: "ab", cursor: 2},
+
+		{name: "CR", inputs: []string{"ls\rab"}, line: "ab", cursor: 2, submitted: []string{"ls"}},
+		{name: "LF", inputs: []string{"ls\nab"}, line: "ab", cursor: 2, submitted: []string{"ls"}},
+		{name: "CRLF is one enter", inputs: []string{"ls\r\nab"}, line: "ab", cursor: 2, submitted: []string{"ls"}},
+		{name: "CRLF split", inputs: []string{"ls\r", "\nab"}, line: "ab", cursor: 2, submitted: []string{"ls"}},
+		{name: "CR CR is two enters", inputs: []string{"ls\r\rab"}, line: "ab", cursor: 2, submitted: []string{"ls", ""}},
+		{name: "LF CR is two enters", inputs: []string{"ls\n\rab"}, line: "ab", cursor: 2, submitted: []string{"ls", ""}},
+		{name: "LF after a key is an enter", inputs: []string{"ls\r", "x\n"}, line: "", cursor: 0, submitted: []string{"ls", "x"}},
+
+		{name: "left over wide rune", inputs: []string{"a日本", left}, line: "a日本", cursor: 2, output: "\x1b[2D"},
+		{name: "right over wide rune", inputs: []string{"a日本", left + left, right}, line: "a日本", cursor: 2, output: "\x1b[2C"},
+		{name: "home over wide runes", inputs: []string{"a日本b", "\x01"}, line: "a日本b", cursor: 0, output: "\x1b[6D"},
+		{name: "end over wide runes", inputs: []string{"a日本b", "\x01", "\x05"}, line: "a日本b", cursor: 4, output: "\x1b[6C"},
+		{name: "left over combining mark", inputs: []string{"éx", left}, line: "éx", cursor: 2, output: "\x1b[1D"},
+		{name: "left stops at the start", inputs: []string{"日", left + left + left}, line: "日", cursor: 0},
+		{name: "right stops at the end", inputs: []string{"日", right}, line: "日", cursor: 1},
+		{name: "backspace wide rune", inputs: []string{"日本\x7f"}, line: "日", cursor: 1},
+		{name: "backspace at the start", inputs: []string{"ab\x01\x08"}, line: "ab", cursor: 0},
+
+		{name: "Ctrl+W", inputs: []string{"foo bar\x17"}, line: "foo ", cursor: 4},
+		{name: "Ctrl+W skips spaces", inputs: []string{"foo bar  \x17"}, line: "foo ", cursor: 4},
+		{name: "Ctrl+W in the middle", inputs: []string{"foo bar baz", left + left + left + left, "\x17"}, line: "foo  baz", cursor: 4},
+		{name: "Ctrl+W at the start", inputs: []string{"foo\x01\x17"}, line: "foo", cursor: 0},
+		{name: "Ctrl+U", inputs: []string{"foo bar", left + left + left, "\x15"}, line: "bar", cursor: 0},
+		{name: "Ctrl+K", inputs: []string{"foo bar", left + left + left, "\x0b"}, line: "foo ", cursor: 4},
+		{name: "Ctrl+K at the end", inputs: []string{"foo\x0b"}, line: "foo", cursor: 3},
+		{name: "Ctrl+C", inputs: []string{"foo\x03"}, line: "", cursor: 0},
+
+		{name: "complete single match", inputs: []string{"ka\t"}, line: "kanban ", cursor: 7},
+		{name: "complete common prefix", inputs: []string{"he\t"}, line: "hel", cursor: 3},
+		{name: "complete lists matches", inputs: []string{"h", "\t"}, line: "h", cursor: 1, output: "\r\nhello  help  history\r\n" + promptText + "h"},
+		{name: "complete no match", inputs: []string{"xy", "\t"}, line: "xy", cursor: 2, output: "\a"},
+		{name: "complete only the first word", inputs: []string{"kanban he", "\t"}, line: "kanban he", cursor: 9, output: "\a"},
+		{name: "complete before the cursor", inputs: []string{"kaxyz", left + left + left, "\t"}, line: "kanban xyz", cursor: 7},
+		{name: "complete wide prefix", inputs: []string{"日\t"}, line: "日本語 ", cursor: 4},
+
+		{name: "history", inputs: []string{"ls\rclear\r", "\x1b[A\x1b[A"}, line: "ls", cursor: 2, submitted: []string{"ls", "clear"}},
+		{name: "history keeps the draft", inputs: []string{"ls\rdra", "\x1b[A\x1b[B"}, line: "dra", cursor: 3, submitted: []string{"ls"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output strings.Builder
+			var submitted []string
+			e := newLineEditor(
+				func(s string) { output.WriteString(s) },
+				func(line string) bool { submitted = append(submitted, line); return true },
+				func() {},
+				func() []string { return []string{"help", "history", "hello", "kanban", "日本語"} })
+
+			for _, input := range tt.inputs {
+				output.Reset()
+				if rest := e.feed(input); rest != "" {
+					t.Fatalf("feed(%q) returned %q", input, rest)
+				}
+			}
+			if got := string(e.line); got != tt.line || e.cursor != tt.cursor {
+				t.Errorf("got line %q with cursor %d, want %q with cursor %d", got, e.cursor, tt.line, tt.cursor)
+			}
+			if !slices.Equal(submitted, tt.submitted) {
+				t.Errorf("submitted %q, want %q", submitted, tt.submitted)
+			}
+			if tt.output != "" && output.String() != tt.output {
+				t.Errorf("wrote %q, want %q", output.String(), tt.output)
+			}
+		})
+	}
+}
+
+// Input after a line that hands the terminal over is returned for the app,
+// apart from the \n completing a \r\n enter.
+func TestLineEditorFeedStopsAtHandover(t *testing.T) {
+	var submitted []string
+	e := newLineEditor(func(string) {}, func(line string) bool {
+		submitted = append(submitted, line)
+		return false
+	}, func() {}, func() []string { return nil })
+
+	tests := []struct {
+		input, rest string
+	}{
+		{"app\rq\x1b[A", "q\x1b[A"},
+		{"app\nq\n", "q\n"},
+		{"app\r\nq\r\n", "q\r\n"},
+		{"app\n\nq", "\nq"},
+		{"app\r", ""},
+	}
+	for _, tt := range tests {
+		if rest := e.feed(tt.input); rest != tt.rest {
+			t.Errorf("feed(%q) returned %q, want %q", tt.input, rest, tt.rest)
+		}
+	}
+	if want := []string{"app", "app", "app", "app", "app"}; !slices.Equal(submitted, want) {
+		t.Errorf("submitted %q, want %q", submitted, want)
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+const defaultAppPath = "/usr/local/bin:/usr/bin:/bin"
+
+// EnvPolicy controls the environment an app is started with. Nothing is
+// inherited from the server unless it is named in Inherit.
+type EnvPolicy struct {
+	Inherit []string          `yaml:"inherit"`
+	Set     map[string]string `yaml:"set"`
+}
+
+// appEnv builds an app's environment from, in increasing precedence: the
+// terminal defaults, what the client reported about its terminal, variables
+// inherited from the server, the app's fixed variables and the session
+// metadata.
+func appEnv(policy EnvPolicy, term clientTerminal, appName, sessionID string) []string {
+	env := map[string]string{
+		"PATH":         defaultAppPath,
+		"TERM":         "xterm-256color",
+		"COLORTERM":    "truecolor",
+		"TERM_PROGRAM": "",
+		"LANG":         "C.UTF-8",
+	}
+	term.applyEnv(env)
+	for _, name := range policy.Inherit {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	for name, value := range policy.Set {
+		env[name] = value
+	}
+	env["TERMINAL_APP"] = appName
+	env["TERMINAL_SESSION_ID"] = sessionID
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]string, 0, len(names))
+	for _, name := range names {
+		vars = append(vars, name+"="+env[name])
+	}
+	return vars
+}
+
+// envValue returns the value of name in vars, as built by appEnv.
+func envValue(vars []string, name string) string {
+	for _, v := range vars {
+		if value, ok := strings.CutPrefix(v, name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
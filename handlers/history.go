@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxRuns             = 20  // runs kept in a session's history
+	maxStderrLines      = 10  // stderr lines kept per run
+	maxStderrLineLength = 256 // bytes kept of each stderr line
+)
+
+// runRecord is one finished app run, as shown by the history command.
+type runRecord struct {
+	App       string
+	Args      []string
+	StartedAt time.Time
+	Duration  time.Duration
+	ExitCode  int
+	Signal    string
+	Reason    string
+	Message   string
+	// StderrCaptured is set for apps with StderrTail, whose last stderr
+	// lines are kept in Stderr.
+	StderrCaptured bool
+	Stderr         []string
+}
+
+// result describes how the run ended in a few words.
+func (r runRecord) result() string {
+	if r.Signal != "" {
+		return "killed by " + r.Signal
+	}
+	return fmt.Sprintf("exited with code %d", r.ExitCode)
+}
+
+// stderrTail keeps the last lines an app wrote to stderr.
+type stderrTail struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(data[:i])
+		data = data[i+1:]
+	}
+	// A line longer than the limit is cut now rather than buffered.
+	if len(data) > maxStderrLineLength {
+		data = data[:maxStderrLineLength]
+	}
+	t.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// add must be called with t.mu held.
+func (t *stderrTail) add(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) > maxStderrLineLength {
+		line = line[:maxStderrLineLength-incompleteUTF8Tail(line[:maxStderrLineLength])]
+	}
+	t.lines = append(t.lines, string(line))
+	if len(t.lines) > maxStderrLines {
+		t.lines = t.lines[len(t.lines)-maxStderrLines:]
+	}
+}
+
+func (t *stderrTail) tail() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, strings.TrimRight(string(t.partial), "\r"))
+	}
+	if len(lines) > maxStderrLines {
+		lines = lines[len(lines)-maxStderrLines:]
+	}
+	return lines
+}
+
+// forwardStderr copies what the app writes to stderr to the terminal, as the
+// PTY would have, while keeping the last lines for the exit report.
+func (s *TerminalSession) forwardStderr(r *os.File, rec *recorder, tail *stderrTail) {
+	defer r.Close()
+
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			tail.Write(buf[:n])
+			s.config.Metrics.ptyOutput(n)
+			// The pipe bypasses the PTY's newline translation.
+			data := append(pending, bytes.ReplaceAll(buf[:n], []byte("\n"), []byte("\r\n"))...)
+			complete := len(data) - incompleteUTF8Tail(data)
+			pending = append([]byte(nil), data[complete:]...)
+			if complete > 0 {
+				rec.output(data[:complete])
+				s.output.write(data[:complete])
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.log.Debug("stderr read ended", "error", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *TerminalSession) recordRun(run runRecord) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs = append(s.runs, run)
+	s.runCount++
+	if len(s.runs) > maxRuns {
+		s.runs = s.runs[len(s.runs)-maxRuns:]
+	}
+	return s.runCount
+}
+
+// showHistory lists the session's runs, or with a run number shows that run
+// in detail, including the end of its stderr when it was captured.
+func (s *TerminalSession) showHistory(args []string) {
+	s.mu.Lock()
+	runs := append([]runRecord(nil), s.runs...)
+	first := s.runCount - len(s.runs) + 1
+	s.mu.Unlock()
+
+	if len(args) > 1 {
+		s.sendError(ErrInvalidArguments, "usage: history [run]")
+		return
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < first || n >= first+len(runs) {
+			s.sendError(ErrInvalidArguments, fmt.Sprintf("history: no run %s", args[0]))
+			return
+		}
+		s.sendOutput(runs[n-first].details(n))
+		return
+	}
+
+	if len(runs) == 0 {
+		s.sendOutput("No apps have run in this session yet\n")
+		return
+	}
+	text := fmt.Sprintf("%4s  %-20s  %-8s  %-9s  %s\n", "Run", "App", "Started", "Runtime", "Result")
+	for i, run := range runs {
+		result := run.result()
+		if run.Reason != "" {
+			result += " (" + run.Reason + ")"
+		}
+		text += fmt.Sprintf("%4d  %-20s  %-8s  %-9s  %s\n", first+i, run.App, run.StartedAt.UTC().Format("15:04:05"), formatRuntime(run.Duration), result)
+	}
+	s.sendOutput(text + "Times are UTC. Type 'history <run>' for details.\n")
+}
+
+func (r runRecord) details(n int) string {
+	text := fmt.Sprintf("Run %d: %s\n", n, strings.Join(append([]string{r.App}, r.Args...), " "))
+	text += fmt.Sprintf("  Started: %s\n", r.StartedAt.UTC().Format(time.RFC3339))
+	text += fmt.Sprintf("  Runtime: %s\n", formatRuntime(r.Duration))
+	text += fmt.Sprintf("  Result:  %s\n", r.result())
+	if r.Reason != "" {
+		text += fmt.Sprintf("  Stopped: %s (%s)\n", r.Message, r.Reason)
+	}
+	if !r.StderrCaptured {
+		return text
+	}
+	if len(r.Stderr) == 0 {
+		return text + "  No stderr output\n"
+	}
+	text += "  Last stderr lines:\n"
+	for _, line := range r.Stderr {
+		text += "    " + line + "\n"
+	}
+	return text
+}
+
+func formatRuntime(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingInterval   = 30 * time.Second
+	defaultPongTimeout    = 10 * time.Second
+	defaultMaxMessageSize = 64 * 1024
+)
+
+// WebSocketConfig bounds what a connection may send and how long it may stay
+// silent. A peer that answers neither pings nor anything else is dropped
+// PingInterval+PongTimeout after it was last heard from.
+type WebSocketConfig struct {
+	PingInterval   time.Duration `yaml:"ping_interval"`    // how often the server pings, defaults to 30s
+	PongTimeout    time.Duration `yaml:"pong_timeout"`     // how long a ping may go unanswered, defaults to 10s
+	MaxMessageSize int64         `yaml:"max_message_size"` // largest inbound message in bytes, defaults to 64 KiB
+}
+
+func (c WebSocketConfig) withDefaults() WebSocketConfig {
+	if c.PingInterval <= 0 {
+		c.PingInterval = defaultPingInterval
+	}
+	if c.PongTimeout <= 0 {
+		c.PongTimeout = defaultPongTimeout
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+	return c
+}
+
+// extendDeadline gives the peer until the next ping has had time to be
+// answered. It is called whenever the peer is heard from.
+func (c WebSocketConfig) extendDeadline(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(c.PingInterval + c.PongTimeout))
+}
+
+// watchReads limits inbound messages and drops a peer that goes quiet. The
+// connection's writer pings every PingInterval; a pong, like any message,
+// extends the read deadline, so when neither arrives the read loop fails
+// and detaches the session.
+func (c WebSocketConfig) watchReads(conn *websocket.Conn) {
+	conn.SetReadLimit(c.MaxMessageSize)
+	c.extendDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		c.extendDeadline(conn)
+		return nil
+	})
+}
+
+func (c *TerminalConfig) webSocketConfig() WebSocketConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.WebSocket.withDefaults()
+}
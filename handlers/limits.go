@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const terminatedLimit = "resource_limit"
+
+// ResourceLimits caps what a launched app may consume. Zero values leave the
+// corresponding limit unset.
+type ResourceLimits struct {
+	AddressSpace uint64 `yaml:"address_space"` // bytes of virtual memory (RLIMIT_AS)
+	CPUSeconds   uint64 `yaml:"cpu_seconds"`   // CPU time before SIGXCPU (RLIMIT_CPU)
+	OpenFiles    uint64 `yaml:"open_files"`    // open file descriptors (RLIMIT_NOFILE)
+	MaxProcesses uint64 `yaml:"max_processes"` // processes for the app's user (RLIMIT_NPROC) and the app's cgroup (pids.max)
+	MemoryMax    uint64 `yaml:"memory_max"`    // bytes of resident memory for the app's cgroup (memory.max)
+}
+
+func limitViolation(state *os.ProcessState, limits ResourceLimits, cg *appCgroup, sandboxed bool) string {
+	if state == nil {
+		return ""
+	}
+
+	if reason := cg.violation(); reason != "" {
+		return reason
+	}
+
+	sig, ok := exitSignal(state, sandboxed)
+	if !ok {
+		return ""
+	}
+
+	cpu := state.UserTime() + state.SystemTime()
+	switch {
+	case sig == syscall.SIGXCPU:
+		return fmt.Sprintf("CPU time limit of %ds exceeded", limits.CPUSeconds)
+	case sig == syscall.SIGKILL && limits.CPUSeconds > 0 && cpu >= time.Duration(limits.CPUSeconds)*time.Second:
+		return fmt.Sprintf("CPU time limit of %ds exceeded", limits.CPUSeconds)
+	}
+	return ""
+}
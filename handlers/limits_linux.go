@@ -0,0 +1,220 @@
+//go:build linux
+
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+type appCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// applyRlimits sets limits on an already started process. The app runs for a
+// few microseconds before they take effect; the cgroup, when available,
+// covers memory and process count from the first instruction.
+func applyRlimits(pid int, limits ResourceLimits) error {
+	if limits.CPUSeconds > 0 {
+		// The one second of slack lets SIGXCPU arrive before the hard limit's SIGKILL.
+		if err := prlimit(pid, unix.RLIMIT_CPU, limits.CPUSeconds, limits.CPUSeconds+1); err != nil {
+			return fmt.Errorf("RLIMIT_CPU: %w", err)
+		}
+	}
+	if limits.AddressSpace > 0 {
+		if err := prlimit(pid, unix.RLIMIT_AS, limits.AddressSpace, limits.AddressSpace); err != nil {
+			return fmt.Errorf("RLIMIT_AS: %w", err)
+		}
+	}
+	if limits.OpenFiles > 0 {
+		if err := prlimit(pid, unix.RLIMIT_NOFILE, limits.OpenFiles, limits.OpenFiles); err != nil {
+			return fmt.Errorf("RLIMIT_NOFILE: %w", err)
+		}
+	}
+	if limits.MaxProcesses > 0 {
+		if err := prlimit(pid, unix.RLIMIT_NPROC, limits.MaxProcesses, limits.MaxProcesses); err != nil {
+			return fmt.Errorf("RLIMIT_NPROC: %w", err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, cur, max uint64) error {
+	var old unix.Rlimit
+	if err := unix.Prlimit(pid, resource, nil, &old); err != nil {
+		return err
+	}
+
+	// An unprivileged server cannot raise a hard limit, only lower it.
+	lim := unix.Rlimit{
+		Cur: min(cur, old.Max),
+		Max: min(max, old.Max),
+	}
+	return unix.Prlimit(pid, resource, &lim, nil)
+}
+
+func (c *TerminalConfig) cgroupParent() string {
+	c.cgroupOnce.Do(func() {
+		parent, err := setupCgroupParent(c.CgroupParent)
+		if err != nil {
+			slog.Warn("cgroup v2 limits unavailable, using rlimits only", "error", err)
+			return
+		}
+		c.cgroupPath = parent
+		slog.Info("Running apps in cgroups", "cgroup_parent", parent)
+	})
+	return c.cgroupPath
+}
+
+func setupCgroupParent(parent string) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("cgroup v2 is not mounted")
+	}
+
+	if parent == "" {
+		self, err := selfCgroup()
+		if err != nil {
+			return "", err
+		}
+		parent = filepath.Join(cgroupRoot, self)
+
+		// A non-root cgroup that contains processes cannot delegate controllers
+		// to its children, so the server moves itself into a leaf first.
+		leaf := filepath.Join(parent, "server")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", err
+		}
+	}
+
+	if err := writeCgroupFile(parent, "cgroup.subtree_control", "+memory +pids"); err != nil {
+		return "", err
+	}
+	return parent, nil
+}
+
+func selfCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("process is not in a cgroup v2 hierarchy")
+}
+
+func (c *TerminalConfig) newAppCgroup(limits ResourceLimits) (*appCgroup, error) {
+	parent := c.cgroupParent()
+	if parent == "" {
+		return nil, nil
+	}
+
+	path, err := os.MkdirTemp(parent, "app-")
+	if err != nil {
+		return nil, err
+	}
+
+	cg := &appCgroup{path: path}
+	if limits.MemoryMax > 0 {
+		if err := writeCgroupFile(path, "memory.max", strconv.FormatUint(limits.MemoryMax, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+		writeCgroupFile(path, "memory.swap.max", "0")
+	}
+	if limits.MaxProcesses > 0 {
+		if err := writeCgroupFile(path, "pids.max", strconv.FormatUint(limits.MaxProcesses, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	cg.dir, err = os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (g *appCgroup) apply(attr *syscall.SysProcAttr) {
+	if g == nil {
+		return
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(g.dir.Fd())
+}
+
+// kill ends every process still in the cgroup. cgroup.kill needs Linux 5.14;
+// on older kernels only the process group is killed.
+func (g *appCgroup) kill() {
+	if g == nil {
+		return
+	}
+	writeCgroupFile(g.path, "cgroup.kill", "1")
+}
+
+func (g *appCgroup) violation() string {
+	if g == nil {
+		return ""
+	}
+	if readCgroupEvent(g.path, "memory.events", "oom_kill") > 0 {
+		return "memory limit exceeded"
+	}
+	if readCgroupEvent(g.path, "pids.events", "max") > 0 {
+		return "process limit reached"
+	}
+	return ""
+}
+
+func (g *appCgroup) remove() {
+	if g == nil {
+		return
+	}
+	if g.dir != nil {
+		g.dir.Close()
+	}
+	if err := os.Remove(g.path); err != nil {
+		slog.Warn("Removing cgroup failed", "cgroup", g.path, "error", err)
+	}
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readCgroupEvent(dir, name, key string) int {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		field, value, ok := strings.Cut(scanner.Text(), " ")
+		if ok && field == key {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
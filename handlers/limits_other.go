@@ -0,0 +1,25 @@
+//go:build !linux
+
+package handlers
+
+import "syscall"
+
+type appCgroup struct{}
+
+func applyRlimits(pid int, limits ResourceLimits) error {
+	return nil
+}
+
+func (c *TerminalConfig) newAppCgroup(limits ResourceLimits) (*appCgroup, error) {
+	return nil, nil
+}
+
+func (g *appCgroup) apply(attr *syscall.SysProcAttr) {}
+
+func (g *appCgroup) kill() {}
+
+func (g *appCgroup) violation() string {
+	return ""
+}
+
+func (g *appCgroup) remove() {}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the server's Prometheus collectors in a registry of its own,
+// so nothing is registered globally. A nil *Metrics records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connections   prometheus.Gauge
+	launches      *prometheus.CounterVec
+	exits         *prometheus.CounterVec
+	durations     *prometheus.HistogramVec
+	rejections    *prometheus.CounterVec
+	ptyBytes      *prometheus.CounterVec
+	resizes       prometheus.Counter
+	contacts      prometheus.Counter
+	contactErrors *prometheus.CounterVec
+	smtpDurations prometheus.Histogram
+	rateLimits    *prometheus.CounterVec
+}
+
+func NewMetrics(config *TerminalConfig) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "terminal_websocket_connections",
+			Help: "Open terminal WebSocket connections.",
+		}),
+		launches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "terminal_app_launches_total",
+			Help: "Apps started, by app.",
+		}, []string{"app"}),
+		exits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "terminal_app_exits_total",
+			Help: "Apps that finished, by app and exit code.",
+		}, []string{"app", "code"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "terminal_app_duration_seconds",
+			Help:    "How long apps ran, by app.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		}, []string{"app"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "terminal_launch_rejections_total",
+			Help: "Launches that were refused, by error code.",
+		}, []string{"reason"}),
+		ptyBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "terminal_pty_bytes_total",
+			Help: "Bytes written to (in) and read from (out) app PTYs.",
+		}, []string{"direction"}),
+		resizes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "terminal_resizes_total",
+			Help: "PTY resizes applied.",
+		}),
+		contacts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "contact_submissions_total",
+			Help: "Contact form submissions received.",
+		}),
+		contactErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "contact_failures_total",
+			Help: "Contact form submissions that failed, by reason.",
+		}, []string{"reason"}),
+		smtpDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "contact_smtp_duration_seconds",
+			Help: "Time taken to send contact form emails.",
+		}),
+		rateLimits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Requests refused by a rate limit, by endpoint and limit (ip, origin or sessions).",
+		}, []string{"endpoint", "limit"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connections, m.launches, m.exits, m.durations, m.rejections,
+		m.ptyBytes, m.resizes, m.contacts, m.contactErrors, m.smtpDurations, m.rateLimits,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "terminal_sessions",
+			Help: "Terminal sessions, including detached ones waiting to be resumed.",
+		}, func() float64 {
+			config.mu.Lock()
+			defer config.mu.Unlock()
+			return float64(len(config.sessions))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "terminal_jobs_running",
+			Help: "Apps currently holding a job slot.",
+		}, func() float64 {
+			config.mu.Lock()
+			defer config.mu.Unlock()
+			return float64(config.currentJobs)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "terminal_jobs_max",
+			Help: "Job slots available (MaxConcurrent).",
+		}, func() float64 {
+			config.mu.Lock()
+			defer config.mu.Unlock()
+			return float64(config.MaxConcurrent)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "terminal_queue_length",
+			Help: "Launches waiting for a job slot.",
+		}, func() float64 {
+			config.mu.Lock()
+			defer config.mu.Unlock()
+			return float64(len(config.waitQueue))
+		}),
+	)
+	return m
+}
+
+func HandleMetrics(m *Metrics) echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+func (m *Metrics) connectionOpened() {
+	if m != nil {
+		m.connections.Inc()
+	}
+}
+
+func (m *Metrics) connectionClosed() {
+	if m != nil {
+		m.connections.Dec()
+	}
+}
+
+func (m *Metrics) appLaunched(appName string) {
+	if m != nil {
+		m.launches.WithLabelValues(appName).Inc()
+	}
+}
+
+func (m *Metrics) appExited(appName string, exitCode int, duration time.Duration) {
+	if m != nil {
+		m.exits.WithLabelValues(appName, strconv.Itoa(exitCode)).Inc()
+		m.durations.WithLabelValues(appName).Observe(duration.Seconds())
+	}
+}
+
+func (m *Metrics) launchRejected(reason string) {
+	if m != nil {
+		m.rejections.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *Metrics) ptyInput(n int) {
+	if m != nil {
+		m.ptyBytes.WithLabelValues("in").Add(float64(n))
+	}
+}
+
+func (m *Metrics) ptyOutput(n int) {
+	if m != nil {
+		m.ptyBytes.WithLabelValues("out").Add(float64(n))
+	}
+}
+
+func (m *Metrics) resized() {
+	if m != nil {
+		m.resizes.Inc()
+	}
+}
+
+func (m *Metrics) contactReceived() {
+	if m != nil {
+		m.contacts.Inc()
+	}
+}
+
+func (m *Metrics) contactFailed(reason string) {
+	if m != nil {
+		m.contactErrors.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *Metrics) smtpFinished(duration time.Duration) {
+	if m != nil {
+		m.smtpDurations.Observe(duration.Seconds())
+	}
+}
+
+func (m *Metrics) rateLimited(endpoint, limit string) {
+	if m != nil {
+		m.rateLimits.WithLabelValues(endpoint, limit).Inc()
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type OutputPolicy string
+
+const (
+	// OutputPause stops reading the PTY while the client is behind, which
+	// blocks the app on its next write until the backlog drains.
+	OutputPause OutputPolicy = "pause"
+	// OutputDrop keeps the app running and discards output that does not fit.
+	OutputDrop OutputPolicy = "drop"
+)
+
+const (
+	defaultCoalesceWindow = 10 * time.Millisecond
+	defaultMaxBuffered    = 256 * 1024
+	defaultWriteTimeout   = 10 * time.Second
+)
+
+// OutputConfig tunes how PTY output is batched and sent to the client.
+type OutputConfig struct {
+	CoalesceWindow time.Duration `yaml:"coalesce_window"` // how long to gather output into one frame, defaults to 10ms
+	MaxBuffered    int           `yaml:"max_buffered"`    // bytes buffered for a slow client, defaults to 256 KiB
+	Policy         OutputPolicy  `yaml:"policy"`          // what happens when the buffer is full, defaults to OutputPause
+	WriteTimeout   time.Duration `yaml:"write_timeout"`   // deadline for each WebSocket write, defaults to 10s
+}
+
+func (c OutputConfig) withDefaults() OutputConfig {
+	if c.CoalesceWindow <= 0 {
+		c.CoalesceWindow = defaultCoalesceWindow
+	}
+	if c.MaxBuffered <= 0 {
+		c.MaxBuffered = defaultMaxBuffered
+	}
+	if c.Policy == "" {
+		c.Policy = OutputPause
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	return c
+}
+
+// outputPipeline sits between the PTY reader and the WebSocket. It collects
+// output for a short window so a burst goes out as one frame, and bounds how
+// much can pile up while the client is slow.
+type outputPipeline struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	flushing bool
+	closed   bool
+	dropped  int
+	config   OutputConfig
+	flush    func([]byte)
+	log      *slog.Logger
+	done     chan struct{}
+}
+
+func newOutputPipeline(config OutputConfig, flush func([]byte), logger *slog.Logger) *outputPipeline {
+	p := &outputPipeline{
+		config: config.withDefaults(),
+		flush:  flush,
+		log:    logger,
+		done:   make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+func (p *outputPipeline) write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.closed && len(p.buf) > 0 && len(p.buf)+len(data) > p.config.MaxBuffered {
+		if p.config.Policy == OutputDrop {
+			p.dropped += len(data)
+			return
+		}
+		p.cond.Wait()
+	}
+	if p.closed {
+		return
+	}
+
+	p.buf = append(p.buf, data...)
+	p.cond.Broadcast()
+}
+
+// drain blocks until everything written so far has been flushed.
+func (p *outputPipeline) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.closed && (len(p.buf) > 0 || p.flushing) {
+		p.cond.Wait()
+	}
+}
+
+// close flushes what is buffered and stops the pipeline. It must not be
+// called while holding the session lock, since flushing takes it.
+func (p *outputPipeline) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	<-p.done
+}
+
+func (p *outputPipeline) run() {
+	defer close(p.done)
+
+	for {
+		p.mu.Lock()
+		for len(p.buf) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.buf) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		closed := p.closed
+		p.mu.Unlock()
+
+		if !closed {
+			time.Sleep(p.config.CoalesceWindow)
+		}
+
+		p.mu.Lock()
+		data := p.buf
+		dropped := p.dropped
+		p.buf = nil
+		p.dropped = 0
+		p.flushing = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+
+		if dropped > 0 {
+			p.log.Warn("Client too slow, dropped output", "bytes", dropped)
+		}
+		p.flush(data)
+
+		p.mu.Lock()
+		p.flushing = false
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
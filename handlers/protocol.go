@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Protocol v2 is negotiated with the "terminal.v2" WebSocket subprotocol, or
+// "terminal.v2.binary" to also receive output as raw binary frames. Clients
+// that ask for neither keep speaking the original v1 protocol.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	subprotocolV2       = "terminal.v2"
+	subprotocolV2Binary = "terminal.v2.binary"
+)
+
+// serverSubprotocols is in order of preference.
+var serverSubprotocols = []string{subprotocolV2Binary, subprotocolV2}
+
+type protocolOptions struct {
+	version      int
+	binaryOutput bool
+}
+
+const (
+	MessageCommand = "command"
+	MessageInput   = "input"
+	MessageResize  = "resize"
+	MessageSignal  = "signal"
+	MessageHello   = "hello"
+)
+
+const (
+	EventOutput        = "output"
+	EventSession       = "session"
+	EventAppStarted    = "app_started"
+	EventAppExited     = "app_exited"
+	EventError         = "error"
+	EventQueuePosition = "queue_position"
+	EventResizeAck     = "resize_ack"
+	EventShutdown      = "shutdown"
+)
+
+const (
+	ErrInvalidMessage     = "invalid_message"
+	ErrInvalidCommand     = "invalid_command"
+	ErrNotRunning         = "not_running"
+	ErrAppNotFound        = "app_not_found"
+	ErrInvalidArguments   = "invalid_arguments"
+	ErrExecutableMissing  = "executable_missing"
+	ErrAlreadyQueued      = "already_queued"
+	ErrQueueFull          = "queue_full"
+	ErrBusy               = "busy"
+	ErrLaunchFailed       = "launch_failed"
+	ErrVerificationFailed = "verification_failed"
+	ErrShuttingDown       = "shutting_down"
+)
+
+// ClientMessage is a message from the client. v1 messages are converted to
+// this form by decodeClientMessage.
+type ClientMessage struct {
+	Type        string `json:"type"`
+	Command     string `json:"command,omitempty"`
+	Data        string `json:"data,omitempty"`
+	Rows        int    `json:"rows,omitempty"`
+	Cols        int    `json:"cols,omitempty"`
+	PixelWidth  int    `json:"pixel_width,omitempty"`
+	PixelHeight int    `json:"pixel_height,omitempty"`
+	ColorDepth  int    `json:"color_depth,omitempty"`
+	Term        string `json:"term,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	Signal      string `json:"signal,omitempty"`
+}
+
+// terminal returns what a hello or resize message reports about the
+// client's terminal.
+func (m ClientMessage) terminal() clientTerminal {
+	return clientTerminal{
+		Rows:        m.Rows,
+		Cols:        m.Cols,
+		PixelWidth:  m.PixelWidth,
+		PixelHeight: m.PixelHeight,
+		ColorDepth:  m.ColorDepth,
+		Term:        m.Term,
+		Locale:      m.Locale,
+	}
+}
+
+type legacyClientMessage struct {
+	Command *string `json:"command"`
+	Input   *string `json:"input"`
+	Resize  *struct {
+		Rows float64 `json:"rows"`
+		Cols float64 `json:"cols"`
+	} `json:"resize"`
+}
+
+func decodeClientMessage(data []byte, protocol int) (ClientMessage, error) {
+	if protocol == ProtocolV2 {
+		var msg ClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return ClientMessage{}, fmt.Errorf("malformed message: %w", err)
+		}
+		switch msg.Type {
+		case MessageCommand, MessageInput:
+		case MessageResize:
+			if msg.Rows <= 0 || msg.Cols <= 0 {
+				return ClientMessage{}, errors.New("resize needs positive rows and cols")
+			}
+			fallthrough
+		case MessageHello:
+			if err := msg.terminal().validate(); err != nil {
+				return ClientMessage{}, err
+			}
+		case MessageSignal:
+			if _, ok := clientSignals[msg.Signal]; !ok {
+				return ClientMessage{}, fmt.Errorf("signal must be SIGINT, SIGTERM or SIGHUP, got %q", msg.Signal)
+			}
+		default:
+			return ClientMessage{}, fmt.Errorf("unknown message type %q", msg.Type)
+		}
+		return msg, nil
+	}
+
+	var legacy legacyClientMessage
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return ClientMessage{}, fmt.Errorf("malformed message: %w", err)
+	}
+	switch {
+	case legacy.Command != nil && *legacy.Command != "":
+		return ClientMessage{Type: MessageCommand, Command: *legacy.Command}, nil
+	case legacy.Input != nil:
+		return ClientMessage{Type: MessageInput, Data: *legacy.Input}, nil
+	case legacy.Resize != nil:
+		return ClientMessage{Type: MessageResize, Rows: int(legacy.Resize.Rows), Cols: int(legacy.Resize.Cols)}, nil
+	}
+	// v1 silently ignored anything it did not recognise.
+	return ClientMessage{}, nil
+}
+
+func negotiateProtocol(subprotocol string) protocolOptions {
+	switch {
+	case strings.EqualFold(subprotocol, subprotocolV2Binary):
+		return protocolOptions{version: ProtocolV2, binaryOutput: true}
+	case strings.EqualFold(subprotocol, subprotocolV2):
+		return protocolOptions{version: ProtocolV2}
+	}
+	return protocolOptions{version: ProtocolV1}
+}
+
+// serverEvent is a message to the client. legacy returns its v1 form, or nil
+// when v1 clients have no equivalent and should not receive it.
+type serverEvent interface {
+	legacy() any
+}
+
+type OutputEvent struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+func (e OutputEvent) legacy() any {
+	return map[string]string{"output": e.Data}
+}
+
+type SessionEvent struct {
+	Type         string `json:"type"`
+	Version      int    `json:"version"`
+	BinaryOutput bool   `json:"binary_output"`
+	SessionID    string `json:"session_id"` // matches session_id in the server log
+	ResumeToken  string `json:"resume_token"`
+	Resumed      bool   `json:"resumed"`
+}
+
+func (e SessionEvent) legacy() any {
+	return map[string]any{
+		"session_id":   e.SessionID,
+		"resume_token": e.ResumeToken,
+		"resumed":      e.Resumed,
+	}
+}
+
+type AppStartedEvent struct {
+	Type string   `json:"type"`
+	App  string   `json:"app"`
+	Args []string `json:"args"`
+	Rows int      `json:"rows"`
+	Cols int      `json:"cols"`
+}
+
+func (e AppStartedEvent) legacy() any {
+	return nil
+}
+
+// AppExitedEvent reports how an app finished. ExitCode follows shell
+// conventions: 128+n when the app was killed by signal n. Reason is set when
+// the server stopped the app itself. Run numbers the session's runs, as
+// listed by the history command.
+type AppExitedEvent struct {
+	Type       string   `json:"type"`
+	App        string   `json:"app"`
+	Run        int      `json:"run"`
+	ExitCode   int      `json:"exit_code"`
+	Signal     string   `json:"signal,omitempty"`
+	DurationMs int64    `json:"duration_ms"`
+	Reason     string   `json:"reason,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	Stderr     []string `json:"stderr,omitempty"` // last lines the app wrote to stderr, for apps with StderrTail
+}
+
+func (e AppExitedEvent) legacy() any {
+	if e.Reason == "" {
+		return nil
+	}
+	return map[string]any{
+		"terminated": map[string]string{
+			"app":     e.App,
+			"reason":  e.Reason,
+			"message": e.Message,
+		},
+	}
+}
+
+type ErrorEvent struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e ErrorEvent) legacy() any {
+	return nil
+}
+
+type QueuePositionEvent struct {
+	Type     string `json:"type"`
+	App      string `json:"app"`
+	Position int    `json:"position"`
+	Length   int    `json:"length"`
+}
+
+func (e QueuePositionEvent) legacy() any {
+	return map[string]any{
+		"queue": map[string]any{
+			"app":      e.App,
+			"position": e.Position,
+			"length":   e.Length,
+		},
+	}
+}
+
+type ResizeAckEvent struct {
+	Type string `json:"type"`
+	Rows int    `json:"rows"`
+	Cols int    `json:"cols"`
+}
+
+func (e ResizeAckEvent) legacy() any {
+	return nil
+}
+
+// ShutdownEvent warns that the server is going away. A running app is
+// stopped once GracePeriodMs has passed; the connection is then closed with
+// code 1012 (service restart).
+type ShutdownEvent struct {
+	Type          string `json:"type"`
+	Message       string `json:"message"`
+	GracePeriodMs int64  `json:"grace_period_ms"`
+}
+
+func (e ShutdownEvent) legacy() any {
+	return nil
+}
+
+// incompleteUTF8Tail returns the number of bytes at the end of p that begin
+// a UTF-8 sequence the next read is expected to finish.
+func incompleteUTF8Tail(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+type queuedLaunch struct {
+	session *TerminalSession
+	appName string
+	args    []string
+}
+
+// reserveJob takes a free job slot, or puts the launch at the back of the
+// wait queue when none is free. position is the 1-based place in the queue
+// and is 0 when the launch was neither started nor queued.
+func (c *TerminalConfig) reserveJob(s *TerminalSession, appName string, args []string) (acquired bool, position int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Newcomers may only take a free slot when nobody is waiting for it.
+	if c.currentJobs < c.MaxConcurrent && len(c.waitQueue) == 0 {
+		c.currentJobs++
+		s.log.Info("Job slot taken", "app", appName, "running", c.currentJobs, "max", c.MaxConcurrent)
+		return true, 0
+	}
+
+	if len(c.waitQueue) >= c.MaxQueueLength {
+		return false, 0
+	}
+	c.waitQueue = append(c.waitQueue, &queuedLaunch{session: s, appName: appName, args: args})
+	s.log.Info("Launch queued", "app", appName, "waiting", len(c.waitQueue))
+	return false, len(c.waitQueue)
+}
+
+// releaseJob hands the slot to the head of the queue, or frees it when
+// nobody is waiting.
+func (c *TerminalConfig) releaseJob(logger *slog.Logger) {
+	c.mu.Lock()
+	if len(c.waitQueue) == 0 {
+		if c.currentJobs > 0 {
+			c.currentJobs--
+		}
+		logger.Info("Job slot freed", "running", c.currentJobs, "max", c.MaxConcurrent)
+		c.mu.Unlock()
+		return
+	}
+
+	next := c.waitQueue[0]
+	c.waitQueue = c.waitQueue[1:]
+	waiting := append([]*queuedLaunch(nil), c.waitQueue...)
+	c.mu.Unlock()
+
+	logger.Info("Job slot handed to queued launch", "waiting", len(waiting))
+	next.session.log.Info("Starting queued launch", "app", next.appName)
+	go next.session.startQueued(next)
+	notifyQueue(waiting)
+}
+
+// startWaiting hands any free slots to the queue, for when MaxConcurrent
+// has been raised by a reload.
+func (c *TerminalConfig) startWaiting() {
+	c.mu.Lock()
+	var starting []*queuedLaunch
+	for c.currentJobs < c.MaxConcurrent && len(c.waitQueue) > 0 {
+		c.currentJobs++
+		starting = append(starting, c.waitQueue[0])
+		c.waitQueue = c.waitQueue[1:]
+	}
+	waiting := append([]*queuedLaunch(nil), c.waitQueue...)
+	c.mu.Unlock()
+
+	if len(starting) == 0 {
+		return
+	}
+	for _, next := range starting {
+		go next.session.startQueued(next)
+	}
+	notifyQueue(waiting)
+}
+
+func (c *TerminalConfig) cancelQueued(s *TerminalSession) bool {
+	c.mu.Lock()
+	removed := false
+	for i, launch := range c.waitQueue {
+		if launch.session == s {
+			c.waitQueue = append(c.waitQueue[:i:i], c.waitQueue[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	waiting := append([]*queuedLaunch(nil), c.waitQueue...)
+	c.mu.Unlock()
+
+	if removed {
+		notifyQueue(waiting)
+	}
+	return removed
+}
+
+func (c *TerminalConfig) isQueued(s *TerminalSession) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, launch := range c.waitQueue {
+		if launch.session == s {
+			return true
+		}
+	}
+	return false
+}
+
+func notifyQueue(waiting []*queuedLaunch) {
+	for i, launch := range waiting {
+		launch.session.sendQueuePosition(launch.appName, i+1, len(waiting))
+	}
+}
+
+func (s *TerminalSession) sendQueuePosition(appName string, position, length int) {
+	s.sendOutput(fmt.Sprintf("\r\x1b[2KWaiting to run %s: position %d of %d in the queue. Press Ctrl+C to cancel.", appName, position, length))
+
+	s.sendEvent(QueuePositionEvent{
+		Type:     EventQueuePosition,
+		App:      appName,
+		Position: position,
+		Length:   length,
+	})
+}
+
+func (s *TerminalSession) startQueued(launch *queuedLaunch) {
+	s.sendOutput(fmt.Sprintf("\r\x1b[2KA slot is free, starting %s\r\n", launch.appName))
+	s.startApp(launch.appName, launch.args)
+}
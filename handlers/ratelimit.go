@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	endpointWebSocket = "websocket"
+	endpointContact   = "contact"
+
+	limitPerIP     = "ip"
+	limitPerOrigin = "origin"
+	limitSessions  = "sessions"
+
+	defaultMaxSessionsPerIP = 5
+
+	// limiterPruneInterval is how often buckets that have refilled are dropped.
+	limiterPruneInterval = time.Minute
+)
+
+// TokenBucket allows Burst requests at once, refilling one every Every.
+type TokenBucket struct {
+	Every time.Duration `yaml:"every"`
+	Burst int           `yaml:"burst"`
+}
+
+// EndpointLimits are the budgets of one endpoint. Each client IP and each
+// Origin has a bucket of its own, and a request must fit in both.
+type EndpointLimits struct {
+	PerIP     TokenBucket `yaml:"per_ip"`
+	PerOrigin TokenBucket `yaml:"per_origin"`
+}
+
+// RateLimits protects the endpoints that cost the most: opening a terminal
+// and sending a contact email. Zero values take the defaults.
+type RateLimits struct {
+	// TrustProxyHeaders takes the client IP from Fly-Client-IP or, failing
+	// that, the last X-Forwarded-For hop. Only enable it behind a proxy that
+	// sets them, or clients can pick their own address.
+	TrustProxyHeaders bool           `yaml:"trust_proxy_headers"`
+	MaxSessionsPerIP  int            `yaml:"max_sessions_per_ip"` // WebSocket sessions open at once, defaults to 5
+	WebSocket         EndpointLimits `yaml:"websocket"`           // new connections, defaults to 10 at once then one every 3s per IP
+	Contact           EndpointLimits `yaml:"contact"`             // submissions, defaults to 3 at once then one every 10m per IP
+}
+
+var defaultRateLimits = RateLimits{
+	MaxSessionsPerIP: defaultMaxSessionsPerIP,
+	WebSocket: EndpointLimits{
+		PerIP:     TokenBucket{Every: 3 * time.Second, Burst: 10},
+		PerOrigin: TokenBucket{Every: 50 * time.Millisecond, Burst: 200},
+	},
+	Contact: EndpointLimits{
+		PerIP:     TokenBucket{Every: 10 * time.Minute, Burst: 3},
+		PerOrigin: TokenBucket{Every: 30 * time.Second, Burst: 20},
+	},
+}
+
+func (r RateLimits) withDefaults() RateLimits {
+	if r.MaxSessionsPerIP <= 0 {
+		r.MaxSessionsPerIP = defaultRateLimits.MaxSessionsPerIP
+	}
+	r.WebSocket = r.WebSocket.withDefaults(defaultRateLimits.WebSocket)
+	r.Contact = r.Contact.withDefaults(defaultRateLimits.Contact)
+	return r
+}
+
+func (l EndpointLimits) withDefaults(d EndpointLimits) EndpointLimits {
+	l.PerIP = l.PerIP.withDefaults(d.PerIP)
+	l.PerOrigin = l.PerOrigin.withDefaults(d.PerOrigin)
+	return l
+}
+
+func (b TokenBucket) withDefaults(d TokenBucket) TokenBucket {
+	if b.Every <= 0 {
+		b.Every = d.Every
+	}
+	if b.Burst <= 0 {
+		b.Burst = d.Burst
+	}
+	return b
+}
+
+func (r RateLimits) validate() error {
+	buckets := []TokenBucket{r.WebSocket.PerIP, r.WebSocket.PerOrigin, r.Contact.PerIP, r.Contact.PerOrigin}
+	for _, b := range buckets {
+		if b.Every < 0 || b.Burst < 0 {
+			return errors.New("limits must not be negative")
+		}
+	}
+	if r.MaxSessionsPerIP < 0 {
+		return errors.New("max_sessions_per_ip must not be negative")
+	}
+	return nil
+}
+
+func (r RateLimits) endpoint(name string) EndpointLimits {
+	if name == endpointContact {
+		return r.Contact
+	}
+	return r.WebSocket
+}
+
+// rateLimiter holds the token buckets and session counts. It lives as long
+// as the server, so buckets survive config reloads.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	sessions  map[string]int
+	lastPrune time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	config  TokenBucket
+	used    time.Time
+}
+
+// bucketRequest asks for a token from the bucket named key, which is
+// created with config and reported as limit when it is empty.
+type bucketRequest struct {
+	key    string
+	limit  string
+	config TokenBucket
+}
+
+// reserve takes a token from each requested bucket. When one of them is
+// empty none is taken, and the wait until it refills is returned with the
+// limit it belongs to.
+func (l *rateLimiter) reserve(now time.Time, requests ...bucketRequest) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	l.prune(now)
+
+	var taken []*rate.Reservation
+	for _, req := range requests {
+		b := l.buckets[req.key]
+		if b == nil {
+			b = &bucket{limiter: rate.NewLimiter(rate.Every(req.config.Every), req.config.Burst), config: req.config}
+			l.buckets[req.key] = b
+		} else if b.config != req.config {
+			// The config was reloaded.
+			b.limiter.SetLimitAt(now, rate.Every(req.config.Every))
+			b.limiter.SetBurstAt(now, req.config.Burst)
+			b.config = req.config
+		}
+		b.used = now
+
+		r := b.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			for _, t := range taken {
+				t.CancelAt(now)
+			}
+			return delay, req.limit
+		}
+		taken = append(taken, r)
+	}
+	return 0, ""
+}
+
+// prune must be called with l.mu held. A bucket idle long enough to have
+// refilled behaves like a new one, so it can go.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < limiterPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.used) > b.config.Every*time.Duration(b.config.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// openSession counts a session against ip, unless ip already has max open.
+func (l *rateLimiter) openSession(ip string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions == nil {
+		l.sessions = make(map[string]int)
+	}
+	if l.sessions[ip] >= max {
+		return false
+	}
+	l.sessions[ip]++
+	return true
+}
+
+func (l *rateLimiter) closeSession(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[ip]--; l.sessions[ip] <= 0 {
+		delete(l.sessions, ip)
+	}
+}
+
+// limitRequest spends one request of endpoint's budget for the client and
+// its Origin. When either is used up it returns how long to wait and which
+// limit was hit.
+func (c *TerminalConfig) limitRequest(endpoint string, r *http.Request) (time.Duration, string) {
+	c.mu.Lock()
+	limits := c.RateLimits.withDefaults().endpoint(endpoint)
+	c.mu.Unlock()
+
+	delay, limit := c.limiter.reserve(time.Now(),
+		bucketRequest{endpoint + "|ip|" + addressKey(c.ClientIP(r)), limitPerIP, limits.PerIP},
+		bucketRequest{endpoint + "|origin|" + r.Header.Get("Origin"), limitPerOrigin, limits.PerOrigin})
+	if delay > 0 {
+		c.Metrics.rateLimited(endpoint, limit)
+	}
+	return delay, limit
+}
+
+// openSession reserves one of the client's concurrent sessions. The returned
+// func gives it back.
+func (c *TerminalConfig) openSession(r *http.Request) (func(), bool) {
+	c.mu.Lock()
+	max := c.RateLimits.withDefaults().MaxSessionsPerIP
+	c.mu.Unlock()
+
+	ip := addressKey(c.ClientIP(r))
+	if !c.limiter.openSession(ip, max) {
+		c.Metrics.rateLimited(endpointWebSocket, limitSessions)
+		return nil, false
+	}
+	return func() { c.limiter.closeSession(ip) }, true
+}
+
+// ClientIP is the address a request came from. With TrustProxyHeaders it is
+// taken from Fly-Client-IP or the last X-Forwarded-For hop, which is the one
+// added by the proxy in front of the server. It also serves as Echo's
+// IPExtractor, so logged addresses match the limited ones.
+func (c *TerminalConfig) ClientIP(r *http.Request) string {
+	c.mu.Lock()
+	trust := c.RateLimits.TrustProxyHeaders
+	c.mu.Unlock()
+
+	if trust {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("Fly-Client-IP"))); ip != nil {
+			return ip.String()
+		}
+		if hops := r.Header.Values("X-Forwarded-For"); len(hops) > 0 {
+			last := hops[len(hops)-1]
+			last = last[strings.LastIndex(last, ",")+1:]
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// addressKey groups IPv6 clients by /64, the block a single host usually
+// gets, so rotating through its addresses does not escape the limits.
+func addressKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// retryAfter formats a wait for the Retry-After header, in whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
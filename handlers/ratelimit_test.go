@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// A request refused by one bucket must not spend tokens from the others.
+func TestReserveRollsBackAcrossBuckets(t *testing.T) {
+	var l rateLimiter
+	perIP := TokenBucket{Every: time.Minute, Burst: 2}
+	perOrigin := TokenBucket{Every: time.Minute, Burst: 1}
+	request := func(ip, origin string) (time.Duration, string) {
+		return l.reserve(testEpoch,
+			bucketRequest{"ip|" + ip, limitPerIP, perIP},
+			bucketRequest{"origin|" + origin, limitPerOrigin, perOrigin})
+	}
+
+	if delay, limit := request("1.2.3.4", "a"); delay != 0 {
+		t.Fatalf("first request was limited by %s", limit)
+	}
+	if delay, limit := request("1.2.3.4", "a"); delay != time.Minute || limit != limitPerOrigin {
+		t.Fatalf("got %s from %q, want %s from %q", delay, limit, time.Minute, limitPerOrigin)
+	}
+	// The refused request gave its IP token back, so one is left.
+	if delay, limit := request("1.2.3.4", "b"); delay != 0 {
+		t.Fatalf("IP token was not given back, limited by %s", limit)
+	}
+	if delay, limit := request("1.2.3.4", "c"); delay != time.Minute || limit != limitPerIP {
+		t.Fatalf("got %s from %q, want %s from %q", delay, limit, time.Minute, limitPerIP)
+	}
+	// And the refused requests left origins b and c untouched.
+	if delay, limit := request("5.6.7.8", "c"); delay != 0 {
+		t.Fatalf("origin token was not given back, limited by %s", limit)
+	}
+}
+
+func TestReserveRefills(t *testing.T) {
+	var l rateLimiter
+	req := bucketRequest{"ip|1.2.3.4", limitPerIP, TokenBucket{Every: time.Minute, Burst: 1}}
+
+	if delay, _ := l.reserve(testEpoch, req); delay != 0 {
+		t.Fatalf("first request was limited for %s", delay)
+	}
+	if delay, _ := l.reserve(testEpoch.Add(20*time.Second), req); delay != 40*time.Second {
+		t.Fatalf("got delay %s, want 40s", delay)
+	}
+	if delay, _ := l.reserve(testEpoch.Add(time.Minute), req); delay != 0 {
+		t.Fatalf("refilled bucket was limited for %s", delay)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	var l rateLimiter
+	short := TokenBucket{Every: time.Second, Burst: 10}
+	long := TokenBucket{Every: time.Hour, Burst: 1}
+
+	l.reserve(testEpoch, bucketRequest{"short", limitPerIP, short}, bucketRequest{"long", limitPerIP, long})
+
+	// Pruning waits for its interval even though short has refilled.
+	l.reserve(testEpoch.Add(30*time.Second), bucketRequest{"other", limitPerIP, short})
+	if l.buckets["short"] == nil {
+		t.Fatal("bucket was pruned before the prune interval")
+	}
+
+	l.reserve(testEpoch.Add(limiterPruneInterval+30*time.Second), bucketRequest{"other", limitPerIP, short})
+	if l.buckets["short"] != nil {
+		t.Error("refilled bucket was not pruned")
+	}
+	if l.buckets["long"] == nil {
+		t.Error("bucket still refilling was pruned")
+	}
+	if l.buckets["other"] == nil {
+		t.Error("bucket in use was pruned")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   bool
+		headers map[string][]string
+		want    string
+	}{
+		{name: "remote address", want: "192.0.2.1"},
+		{name: "headers ignored without trust", headers: map[string][]string{
+			"Fly-Client-IP":   {"203.0.113.7"},
+			"X-Forwarded-For": {"203.0.113.8"},
+		}, want: "192.0.2.1"},
+		{name: "fly client ip", trust: true, headers: map[string][]string{
+			"Fly-Client-IP":   {" 203.0.113.7 "},
+			"X-Forwarded-For": {"203.0.113.8"},
+		}, want: "203.0.113.7"},
+		{name: "fly client ip ipv6", trust: true, headers: map[string][]string{
+			"Fly-Client-IP": {"2001:DB8::1"},
+		}, want: "2001:db8::1"},
+		{name: "invalid fly client ip", trust: true, headers: map[string][]string{
+			"Fly-Client-IP":   {"unknown"},
+			"X-Forwarded-For": {"203.0.113.8"},
+		}, want: "203.0.113.8"},
+		{name: "last forwarded hop", trust: true, headers: map[string][]string{
+			"X-Forwarded-For": {"198.51.100.1, 203.0.113.8"},
+		}, want: "203.0.113.8"},
+		{name: "last forwarded header", trust: true, headers: map[string][]string{
+			"X-Forwarded-For": {"198.51.100.1", "198.51.100.2,203.0.113.8"},
+		}, want: "203.0.113.8"},
+		{name: "invalid last hop", trust: true, headers: map[string][]string{
+			"X-Forwarded-For": {"203.0.113.8, spoofed"},
+		}, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &TerminalConfig{RateLimits: RateLimits{TrustProxyHeaders: tt.trust}}
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for name, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(name, v)
+				}
+			}
+			if got := c.ClientIP(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressKey(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"::ffff:203.0.113.7", "::ffff:203.0.113.7"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::ffff", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := addressKey(tt.addr); got != tt.want {
+			t.Errorf("addressKey(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
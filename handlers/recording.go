@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const recordingExt = ".cast"
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type RecordingInfo struct {
+	Name     string    `json:"name"`
+	App      string    `json:"app"`
+	Size     int64     `json:"size"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// recorder writes a terminal session to disk in asciicast v2 format.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	start time.Time
+	log   *slog.Logger
+	// withInput records keystrokes as well as output.
+	withInput bool
+}
+
+func newRecorder(dir, appName string, cols, rows int, env map[string]string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recordings directory: %w", err)
+	}
+
+	start := time.Now()
+	name := fmt.Sprintf("%s-%s-%s%s", appName, start.UTC().Format("20060102T150405"), strings.ToLower(rand.Text()[:6]), recordingExt)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: start.Unix(),
+		Title:     appName,
+		Env:       env,
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recorder{file: file, w: w, enc: enc, start: start}, nil
+}
+
+func (r *recorder) event(kind, data string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if err := r.enc.Encode([]any{time.Since(r.start).Seconds(), kind, data}); err != nil {
+		r.log.Warn("Recording write failed", "error", err)
+	}
+}
+
+func (r *recorder) output(data []byte) {
+	r.event("o", string(data))
+}
+
+func (r *recorder) input(data string) {
+	if r == nil || !r.withInput {
+		return
+	}
+	r.event("i", data)
+}
+
+func (r *recorder) resize(cols, rows uint16) {
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
+
+func (c *TerminalConfig) startRecording(logger *slog.Logger, appName string, withInput bool, cols, rows int, env map[string]string) *recorder {
+	dir, _ := c.recordings()
+	if dir == "" {
+		return nil
+	}
+
+	rec, err := newRecorder(dir, appName, cols, rows, env)
+	if err != nil {
+		logger.Error("Starting recording failed", "app", appName, "error", err)
+		return nil
+	}
+	rec.log = logger.With("recording", filepath.Base(rec.file.Name()))
+	rec.withInput = withInput
+	logger.Info("Recording app", "app", appName, "recording", filepath.Base(rec.file.Name()))
+	return rec
+}
+
+func (c *TerminalConfig) finishRecording(logger *slog.Logger, rec *recorder) {
+	if rec == nil {
+		return
+	}
+
+	if err := rec.Close(); err != nil {
+		logger.Error("Closing recording failed", "error", err)
+	}
+
+	dir, keep := c.recordings()
+	if err := pruneRecordings(dir, keep); err != nil {
+		logger.Error("Pruning recordings failed", "error", err)
+	}
+}
+
+func ListRecordings(dir string) ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []RecordingInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []RecordingInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != recordingExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{
+			Name:     entry.Name(),
+			App:      recordingTitle(filepath.Join(dir, entry.Name())),
+			Size:     info.Size(),
+			Recorded: info.ModTime(),
+		})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Recorded.After(recordings[j].Recorded)
+	})
+	return recordings, nil
+}
+
+func recordingTitle(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return ""
+	}
+
+	var header castHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return ""
+	}
+	return header.Title
+}
+
+func pruneRecordings(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	recordings, err := ListRecordings(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recordings[min(keep, len(recordings)):] {
+		if err := os.Remove(filepath.Join(dir, rec.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func HandleListRecordings(config *TerminalConfig) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		dir, _ := config.recordings()
+		recordings, err := ListRecordings(dir)
+		if err != nil {
+			slog.Error("Listing recordings failed", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to list recordings",
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]any{
+			"recordings": recordings,
+		})
+	}
+}
+
+func HandleGetRecording(config *TerminalConfig) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if name != filepath.Base(name) || filepath.Ext(name) != recordingExt {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid recording name",
+			})
+		}
+		dir, _ := config.recordings()
+		return c.File(filepath.Join(dir, name))
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+type ringBuffer struct {
+	data   []byte
+	start  int
+	length int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.data)
+	if size == 0 {
+		return
+	}
+
+	if len(p) >= size {
+		copy(r.data, p[len(p)-size:])
+		r.start = 0
+		r.length = size
+		return
+	}
+
+	end := (r.start + r.length) % size
+	n := copy(r.data[end:], p)
+	copy(r.data, p[n:])
+
+	r.length += len(p)
+	if r.length > size {
+		r.start = (r.start + r.length - size) % size
+		r.length = size
+	}
+}
+
+func (r *ringBuffer) Bytes() []byte {
+	out := make([]byte, r.length)
+	n := copy(out, r.data[r.start:min(r.start+r.length, len(r.data))])
+	copy(out[n:], r.data[:r.length-n])
+	return out
+}
+
+// newTerminalSession must be called with config.mu held.
+func newTerminalSession(conn *websocket.Conn, protocol protocolOptions, pingInterval time.Duration, config *TerminalConfig) *TerminalSession {
+	s := &TerminalSession{
+		protocol:   protocol,
+		config:     config,
+		id:         rand.Text()[:12],
+		token:      rand.Text(),
+		scrollback: newRingBuffer(config.ScrollbackSize),
+	}
+	s.log = slog.With("session_id", s.id)
+	s.editor = newLineEditor(s.sendOutput, s.runLine, s.interruptLine, config.commandNames)
+	s.output = newOutputPipeline(config.Output, s.sendRawOutput, s.log)
+	s.writer = newConnWriter(conn, s.output.config.WriteTimeout, pingInterval, s.log)
+	return s
+}
+
+// attachSession reattaches conn to the detached session identified by token,
+// or registers a fresh session when the token is empty, unknown or expired.
+func (c *TerminalConfig) attachSession(token string, conn *websocket.Conn, protocol protocolOptions, pingInterval time.Duration) (*TerminalSession, bool) {
+	if token != "" {
+		c.mu.Lock()
+		session, ok := c.sessions[token]
+		c.mu.Unlock()
+
+		// attach may wait for the session's senders, so it runs without c.mu.
+		if ok && session.attach(conn, protocol, pingInterval) {
+			return session, true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = make(map[string]*TerminalSession)
+	}
+	session := newTerminalSession(conn, protocol, pingInterval, c)
+	c.sessions[session.token] = session
+	return session, false
+}
+
+func (c *TerminalConfig) removeSession(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sessions, token)
+}
+
+// attach hands the session to conn and sends it the resume token and the
+// scrollback, ahead of any output produced meanwhile.
+func (s *TerminalSession) attach(conn *websocket.Conn, protocol protocolOptions, pingInterval time.Duration) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+	// A client that reconnects before its old socket noticed the drop takes
+	// the session over; the stale read loop will fail and detach as a no-op.
+	// Closing the old writer also frees a sender stuck on the dead socket, so
+	// taking sendMu below does not wait out its write timeout.
+	if s.writer != nil {
+		s.writer.close()
+		s.writer = nil
+	}
+	s.mu.Unlock()
+
+	attached := false
+	s.send(func() []outboundFrame {
+		// The session may have expired while the old writer was being closed.
+		if s.closed {
+			return nil
+		}
+		s.writer = newConnWriter(conn, s.output.config.WriteTimeout, pingInterval, s.log)
+		s.protocol = protocol
+		attached = true
+
+		frames := s.sessionFramesLocked(true)
+		// Old output dropped by the ring buffer may have split a rune, whose
+		// tail would otherwise reach the client as U+FFFD.
+		data := s.scrollback.Bytes()
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+			data = data[1:]
+		}
+		if len(data) > 0 {
+			frames = append(frames, s.outputFramesLocked(data)...)
+		}
+		return frames
+	})
+	return attached
+}
+
+// detach keeps a session with a running app for the resume grace period and
+// closes any other. A queued launch is given up rather than kept waiting, so
+// a slot is never handed to a client that has left.
+func (s *TerminalSession) detach(conn *websocket.Conn) {
+	grace := s.config.resumeGracePeriod()
+
+	s.mu.Lock()
+	if s.writer == nil || s.writer.conn != conn {
+		s.mu.Unlock()
+		return
+	}
+	s.writer.close()
+	s.writer = nil
+
+	if s.ptmx != nil && grace > 0 {
+		s.detachTimer = time.AfterFunc(grace, s.expire)
+		s.mu.Unlock()
+		s.log.Info("Session detached, keeping app alive", "grace_period", grace)
+		return
+	}
+	s.mu.Unlock()
+
+	s.close()
+}
+
+func (s *TerminalSession) expire() {
+	s.mu.Lock()
+	if s.writer != nil || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.cleanupLocked()
+	s.mu.Unlock()
+
+	s.output.close()
+	s.config.cancelQueued(s)
+	s.config.removeSession(s.token)
+	s.log.Info("Session resume grace period expired")
+}
+
+func (s *TerminalSession) close() {
+	s.cleanup()
+	s.config.cancelQueued(s)
+	s.config.removeSession(s.token)
+}
+
+func (s *TerminalSession) sendResumeToken() {
+	s.send(func() []outboundFrame {
+		return s.sessionFramesLocked(false)
+	})
+}
+
+func (s *TerminalSession) sessionFramesLocked(resumed bool) []outboundFrame {
+	return s.eventFramesLocked(SessionEvent{
+		Type:         EventSession,
+		Version:      s.protocol.version,
+		BinaryOutput: s.protocol.binaryOutput,
+		SessionID:    s.id,
+		ResumeToken:  s.token,
+		Resumed:      resumed,
+	})
+}
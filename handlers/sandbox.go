@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type NetworkPolicy string
+
+const (
+	// NetworkNone gives the app an empty network namespace with no interfaces up.
+	NetworkNone NetworkPolicy = "none"
+	// NetworkHost shares the server's network so the app can make outbound requests.
+	NetworkHost NetworkPolicy = "host"
+)
+
+// SandboxConfig runs an app in fresh user, mount, PID and (by default)
+// network namespaces with a read-only root and a private tmpfs home.
+type SandboxConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Network  NetworkPolicy `yaml:"network"`   // defaults to NetworkNone
+	Home     string        `yaml:"home"`      // tmpfs mount point used as $HOME, defaults to /tmp
+	HomeSize uint64        `yaml:"home_size"` // tmpfs size in bytes, defaults to 16 MiB
+}
+
+const (
+	sandboxInitName        = "portfolio-sandbox-init"
+	defaultSandboxHome     = "/tmp"
+	defaultSandboxHomeSize = 16 << 20
+)
+
+// checkVisible reports an error when the tmpfs home of a sandboxed app would
+// hide its apps directory or working directory, which the app could then
+// not see. Relative paths are resolved like the server resolves them.
+func (c SandboxConfig) checkVisible(appsDir, workingDir string) error {
+	if !c.Enabled {
+		return nil
+	}
+	home := c.Home
+	if home == "" {
+		home = defaultSandboxHome
+	}
+
+	paths := []string{appsDir}
+	if workingDir != "" {
+		if !filepath.IsAbs(workingDir) {
+			workingDir = filepath.Join(appsDir, workingDir)
+		}
+		paths = append(paths, workingDir)
+	}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(home, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is under sandbox.home %s, which hides it inside the sandbox", path, home)
+		}
+	}
+	return nil
+}
+
+type sandboxSpec struct {
+	Home     string `json:"home"`
+	HomeSize uint64 `json:"home_size"`
+	Dir      string `json:"dir,omitempty"`
+}
+
+// appSandbox holds the pipe that keeps the sandbox init waiting until the
+// parent has finished applying resource limits to it.
+type appSandbox struct {
+	gate  *os.File
+	child *os.File
+}
+
+func (sb *appSandbox) started() {
+	if sb != nil {
+		sb.child.Close()
+	}
+}
+
+func (sb *appSandbox) release() {
+	if sb != nil {
+		sb.gate.Close()
+	}
+}
+
+// exitSignal reports the signal that terminated an app. The sandbox init
+// cannot re-raise a signal on itself as PID 1, so it exits with 128+signal
+// like a shell does.
+func exitSignal(state *os.ProcessState, sandboxed bool) (syscall.Signal, bool) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, false
+	}
+	if status.Signaled() {
+		return status.Signal(), true
+	}
+	if sandboxed && status.Exited() && status.ExitStatus() > 128 {
+		return syscall.Signal(status.ExitStatus() - 128), true
+	}
+	return 0, false
+}
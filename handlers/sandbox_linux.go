@@ -0,0 +1,227 @@
+//go:build linux
+
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SandboxInit must be called first thing in main. When the process was
+// re-executed as a sandbox init it sets up the namespaces, runs the app and
+// exits without returning.
+func SandboxInit() {
+	if len(os.Args) < 3 || os.Args[0] != sandboxInitName {
+		return
+	}
+
+	code, err := runSandboxInit(os.Args[1], os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(126)
+	}
+	os.Exit(code)
+}
+
+func applySandbox(cmd *exec.Cmd, config SandboxConfig) (*appSandbox, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	spec := sandboxSpec{
+		Home:     config.Home,
+		HomeSize: config.HomeSize,
+	}
+	if spec.Home == "" {
+		spec.Home = defaultSandboxHome
+	}
+	if spec.HomeSize == 0 {
+		spec.HomeSize = defaultSandboxHomeSize
+	}
+	if cmd.Dir != "" {
+		dir, err := filepath.Abs(cmd.Dir)
+		if err != nil {
+			return nil, err
+		}
+		spec.Dir = dir
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	child, gate, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// The init gets the gate as fd 3 and the executable execVerified set up
+	// as fd 4, and passes the executable on to the app as appExecutableFD.
+	// Its own path would be resolved only after the init's setup, and may
+	// not be visible inside the sandbox at all.
+	cmd.Args = append([]string{sandboxInitName, string(specJSON)}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.ExtraFiles = append([]*os.File{child}, cmd.ExtraFiles...)
+
+	attr := cmd.SysProcAttr
+	attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if config.Network != NetworkHost {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+
+	return &appSandbox{gate: gate, child: child}, nil
+}
+
+func runSandboxInit(specJSON string, argv []string) (int, error) {
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return 0, fmt.Errorf("invalid spec: %w", err)
+	}
+
+	// Capability and no_new_privs changes are per thread, so the app must be
+	// forked from the thread that made them.
+	runtime.LockOSThread()
+
+	// Block until the server has applied rlimits so the app inherits them.
+	gate := os.NewFile(3, "sandbox-gate")
+	io.Copy(io.Discard, gate)
+	gate.Close()
+
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return 0, fmt.Errorf("make mounts private: %w", err)
+	}
+	if err := remountReadOnly(); err != nil {
+		return 0, err
+	}
+	if err := unix.Mount("tmpfs", spec.Home, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, fmt.Sprintf("size=%d,mode=0700", spec.HomeSize)); err != nil {
+		return 0, fmt.Errorf("mount home: %w", err)
+	}
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return 0, fmt.Errorf("mount /proc: %w", err)
+	}
+	dir := spec.Home
+	if spec.Dir != "" {
+		dir = spec.Dir
+	}
+	if err := os.Chdir(dir); err != nil {
+		return 0, err
+	}
+
+	// The init is root inside the user namespace. Emptying the bounding set
+	// means the app starts without capabilities and cannot undo the mounts.
+	for c := 0; c <= unix.CAP_LAST_CAP; c++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return 0, fmt.Errorf("drop capabilities: %w", err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return 0, fmt.Errorf("set no_new_privs: %w", err)
+	}
+
+	exe := os.NewFile(4, "app")
+	cmd := exec.Command(fmt.Sprintf("/proc/self/fd/%d", appExecutableFD), argv[1:]...)
+	cmd.Args[0] = argv[0]
+	cmd.ExtraFiles = []*os.File{exe}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "HOME="+spec.Home)
+
+	// The app stays in the init's process group, and the server signals the
+	// whole group, so signals reach the app directly. The init only has to
+	// outlive them until the app exits.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	cmd.Wait()
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return status.ExitStatus(), nil
+}
+
+func remountReadOnly() error {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		if isPseudoMount(mount) {
+			continue
+		}
+
+		// Flags locked by the parent namespace must be kept on remount.
+		var st unix.Statfs_t
+		if err := unix.Statfs(mount, &st); err != nil {
+			return fmt.Errorf("statfs %s: %w", mount, err)
+		}
+		keep := uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+		if err := unix.Mount("", mount, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|keep, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", mount, err)
+		}
+	}
+	return nil
+}
+
+func isPseudoMount(path string) bool {
+	for _, prefix := range []string{"/proc", "/sys", "/dev"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
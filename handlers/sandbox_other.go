@@ -0,0 +1,17 @@
+//go:build !linux
+
+package handlers
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func SandboxInit() {}
+
+func applySandbox(cmd *exec.Cmd, config SandboxConfig) (*appSandbox, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	return nil, errors.New("sandbox mode requires Linux")
+}
@@ -0,0 +1,673 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const testOrigin = "http://localhost:5173"
+
+// testServer runs HandleWebSocket with apps that are shell scripts.
+type testServer struct {
+	config *TerminalConfig
+	url    string
+}
+
+func newTestServer(t *testing.T, apps map[string]string, configure func(*TerminalConfig)) *testServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	config := &TerminalConfig{
+		AppsDirectory:  dir,
+		Apps:           make(map[string]AppManifest),
+		AllowedOrigins: map[string]bool{testOrigin: true},
+		MaxConcurrent:  8,
+		ScrollbackSize: 64 * 1024,
+	}
+	for name, script := range apps {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		config.Apps[name] = AppManifest{Description: name}
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	e := echo.New()
+	e.GET("/ws", HandleWebSocket(config))
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	return &testServer{config: config, url: "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"}
+}
+
+func (ts *testServer) session(t *testing.T) *TerminalSession {
+	t.Helper()
+
+	ts.config.mu.Lock()
+	defer ts.config.mu.Unlock()
+
+	if len(ts.config.sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(ts.config.sessions))
+	}
+	for _, s := range ts.config.sessions {
+		return s
+	}
+	return nil
+}
+
+// waitIdle waits until every session is gone and every job slot is free.
+func (ts *testServer) waitIdle(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		ts.config.mu.Lock()
+		sessions, jobs := len(ts.config.sessions), ts.config.currentJobs
+		ts.config.mu.Unlock()
+		if sessions == 0 && jobs == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("sessions were not cleaned up")
+}
+
+type testEvent struct {
+	Type        string   `json:"type"`
+	Data        string   `json:"data"`
+	ResumeToken string   `json:"resume_token"`
+	Resumed     bool     `json:"resumed"`
+	App         string   `json:"app"`
+	Run         int      `json:"run"`
+	ExitCode    int      `json:"exit_code"`
+	Code        string   `json:"code"`
+	Stderr      []string `json:"stderr"`
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	output strings.Builder
+}
+
+func (ts *testServer) dial(t *testing.T, query string) *testClient {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolV2}}
+	conn, _, err := dialer.Dial(ts.url+query, http.Header{"Origin": {testOrigin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) send(msg ClientMessage) {
+	c.t.Helper()
+
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next reads one event, collecting terminal output along the way.
+func (c *testClient) next() (testEvent, error) {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var event testEvent
+	if err := c.conn.ReadJSON(&event); err != nil {
+		return testEvent{}, err
+	}
+	if event.Type == EventOutput {
+		c.output.WriteString(event.Data)
+	}
+	return event, nil
+}
+
+// readUntil reads events up to and including the first of eventType.
+func (c *testClient) readUntil(eventType string) (testEvent, error) {
+	for {
+		event, err := c.next()
+		if err != nil {
+			return testEvent{}, fmt.Errorf("waiting for %s: %w", eventType, err)
+		}
+		if event.Type == eventType {
+			return event, nil
+		}
+	}
+}
+
+func (c *testClient) waitFor(eventType string) testEvent {
+	c.t.Helper()
+
+	event, err := c.readUntil(eventType)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return event
+}
+
+// numbers returns the lines of the output collected so far that are numbers.
+func (c *testClient) numbers() []int {
+	var numbers []int
+	for _, line := range strings.Split(c.output.String(), "\n") {
+		if n, err := strconv.Atoi(strings.TrimSpace(line)); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+func checkSequence(t *testing.T, got []int, n int) {
+	t.Helper()
+
+	if len(got) != n {
+		t.Fatalf("got %d numbers, want %d", len(got), n)
+	}
+	for i, v := range got {
+		if v != i+1 {
+			t.Fatalf("number %d is %d, output is out of order", i+1, v)
+		}
+	}
+}
+
+// Events sent from other goroutines while an app floods the terminal must
+// neither interleave with output frames nor reorder them, and the exit must
+// be reported after the last of the output.
+func TestConcurrentOutputKeepsOrder(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"count": "exec seq 1 20000"}, nil)
+	c := ts.dial(t, "")
+	c.waitFor(EventSession)
+	s := ts.session(t)
+
+	c.send(ClientMessage{Type: MessageCommand, Command: "count"})
+	c.waitFor(EventAppStarted)
+	c.output.Reset()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 200 {
+				s.sendEvent(ResizeAckEvent{Type: EventResizeAck, Rows: 24, Cols: 80})
+			}
+		})
+	}
+	wg.Go(func() {
+		for i := range 50 {
+			s.handleResize(24+i%10, 80, 0, 0)
+			s.handleHello(clientTerminal{Rows: 30, Cols: 100, ColorDepth: 24})
+		}
+	})
+
+	exit := c.waitFor(EventAppExited)
+	wg.Wait()
+
+	if exit.ExitCode != 0 || exit.Run != 1 {
+		t.Errorf("got exit code %d for run %d, want 0 for run 1", exit.ExitCode, exit.Run)
+	}
+	checkSequence(t, c.numbers(), 20000)
+}
+
+// Several sessions finishing apps at the same time each get all of their
+// own output followed by their own exit report.
+func TestConcurrentExits(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"count": "seq 1 2000; exit 3"}, nil)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		c := ts.dial(t, "")
+		c.waitFor(EventSession)
+		c.send(ClientMessage{Type: MessageCommand, Command: "count"})
+		wg.Go(func() {
+			if _, err := c.readUntil(EventAppStarted); err != nil {
+				t.Error(err)
+				return
+			}
+			c.output.Reset()
+			exit, err := c.readUntil(EventAppExited)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if exit.ExitCode != 3 {
+				t.Errorf("got exit code %d, want 3", exit.ExitCode)
+			}
+			if got := len(c.numbers()); got != 2000 {
+				t.Errorf("got %d numbers before the exit report, want 2000", got)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// A client that drops while its app floods the terminal must not leave the
+// app, its job slot or its session behind.
+func TestDisconnectDuringOutput(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"flood": "exec yes"}, nil)
+	c := ts.dial(t, "")
+	c.waitFor(EventSession)
+
+	c.send(ClientMessage{Type: MessageCommand, Command: "flood"})
+	c.waitFor(EventAppStarted)
+	for range 20 {
+		c.waitFor(EventOutput)
+	}
+	go c.conn.WriteJSON(ClientMessage{Type: MessageResize, Rows: 40, Cols: 100})
+	c.conn.Close()
+
+	ts.waitIdle(t)
+}
+
+// Reconnecting with the resume token while the old connection is still open
+// and busy hands the session to the new connection.
+func TestResumeWhileConnected(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"echo": "exec cat"}, func(c *TerminalConfig) {
+		c.ResumeGracePeriod = 5 * time.Second
+	})
+	old := ts.dial(t, "")
+	token := old.waitFor(EventSession).ResumeToken
+
+	old.send(ClientMessage{Type: MessageCommand, Command: "echo"})
+	old.waitFor(EventAppStarted)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for range 100 {
+			if old.conn.WriteJSON(ClientMessage{Type: MessageInput, Data: "old\r"}) != nil {
+				return
+			}
+		}
+	})
+	wg.Go(func() {
+		for {
+			if _, err := old.next(); err != nil {
+				return
+			}
+		}
+	})
+
+	c := ts.dial(t, "?resume="+token)
+	if event := c.waitFor(EventSession); !event.Resumed {
+		t.Fatal("session was not resumed")
+	}
+	wg.Wait()
+
+	c.send(ClientMessage{Type: MessageInput, Data: "resumed\r"})
+	for !strings.Contains(c.output.String(), "resumed\r\nresumed") {
+		if _, err := c.next(); err != nil {
+			t.Fatalf("cat's echo did not reach the new connection: %v", err)
+		}
+	}
+
+	// Without a connection the session would wait out its grace period.
+	c.conn.Close()
+	ts.session(t).close()
+	ts.waitIdle(t)
+}
+
+// Resuming from a new connection while the old one has stopped reading, as
+// after a network switch, must not wait for the old connection's writes to
+// time out, nor hold up other requests meanwhile.
+func TestResumeFromStalledConnection(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"flood": "exec yes"}, func(c *TerminalConfig) {
+		c.ResumeGracePeriod = 5 * time.Second
+		c.Output.WriteTimeout = time.Minute
+	})
+	old := ts.dial(t, "")
+	token := old.waitFor(EventSession).ResumeToken
+
+	old.send(ClientMessage{Type: MessageCommand, Command: "flood"})
+	old.waitFor(EventAppStarted)
+	// Stop reading until the socket buffers fill and the writer is stuck.
+	time.Sleep(time.Second)
+
+	resumed := make(chan struct{})
+	go func() {
+		defer close(resumed)
+		dialer := websocket.Dialer{Subprotocols: []string{subprotocolV2}}
+		conn, _, err := dialer.Dial(ts.url+"?resume="+token, http.Header{"Origin": {testOrigin}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		c := &testClient{t: t, conn: conn}
+		if event, err := c.readUntil(EventSession); err != nil || !event.Resumed {
+			t.Errorf("session was not resumed: %v", err)
+		}
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-resumed:
+			done = true
+		case <-deadline:
+			t.Fatal("resuming waited for the stalled connection")
+		default:
+			start := time.Now()
+			ts.config.OriginAllowed(testOrigin)
+			if wait := time.Since(start); wait > time.Second {
+				t.Fatalf("config was locked for %s during the resume", wait)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ts.session(t).close()
+	ts.waitIdle(t)
+}
+
+// Scrollback that the ring buffer cut in the middle of a rune is replayed
+// from the next whole rune.
+func TestResumeScrollbackStartsOnRune(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"accents": "printf 'ééééé'; exec sleep 10"}, func(c *TerminalConfig) {
+		c.ResumeGracePeriod = 5 * time.Second
+		c.ScrollbackSize = 7
+	})
+	old := ts.dial(t, "")
+	token := old.waitFor(EventSession).ResumeToken
+
+	old.send(ClientMessage{Type: MessageCommand, Command: "accents"})
+	for !strings.Contains(old.output.String(), "ééééé") {
+		if _, err := old.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.conn.Close()
+
+	c := ts.dial(t, "?resume="+token)
+	if event := c.waitFor(EventSession); !event.Resumed {
+		t.Fatal("session was not resumed")
+	}
+	if got := c.waitFor(EventOutput).Data; got != "ééé" {
+		t.Errorf("got scrollback %q, want %q", got, "ééé")
+	}
+
+	c.conn.Close()
+	ts.session(t).close()
+	ts.waitIdle(t)
+}
+
+// Apps keep stderr on the terminal unless their manifest asks for its tail
+// in the exit report.
+func TestStderrTail(t *testing.T) {
+	script := "[ -t 2 ] && echo stderr is a terminal; echo oops >&2; exit 1"
+	ts := newTestServer(t, map[string]string{"plain": script, "tail": script}, func(c *TerminalConfig) {
+		c.Apps["tail"] = AppManifest{Description: "tail", StderrTail: true}
+	})
+	c := ts.dial(t, "")
+	c.waitFor(EventSession)
+
+	for _, tc := range []struct {
+		app      string
+		terminal bool
+		stderr   []string
+	}{
+		{"plain", true, nil},
+		{"tail", false, []string{"oops"}},
+	} {
+		c.send(ClientMessage{Type: MessageCommand, Command: tc.app})
+		c.waitFor(EventAppStarted)
+		c.output.Reset()
+		exit := c.waitFor(EventAppExited)
+
+		if got := strings.Contains(c.output.String(), "stderr is a terminal"); got != tc.terminal {
+			t.Errorf("%s: stderr is a terminal: %v, want %v", tc.app, got, tc.terminal)
+		}
+		if !slices.Equal(exit.Stderr, tc.stderr) {
+			t.Errorf("%s: got stderr %q, want %q", tc.app, exit.Stderr, tc.stderr)
+		}
+		c.send(ClientMessage{Type: MessageInput, Data: "\r"})
+	}
+}
+
+// A process the app started that ignores SIGHUP and SIGTERM must not outlive
+// the app, whether the app is stopped because its client left or exits on
+// its own.
+func TestAppProcessGroupIsReaped(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	orphan := "(trap '' HUP TERM; exec sleep 4242) & echo $! > " + pidFile + "; "
+	ts := newTestServer(t, map[string]string{
+		"linger": orphan + "sleep 100",
+		"leave":  orphan + "exit 0",
+	}, nil)
+
+	for _, tc := range []struct {
+		app        string
+		disconnect bool
+	}{
+		{"linger", true},
+		{"leave", false},
+	} {
+		os.Remove(pidFile)
+		c := ts.dial(t, "")
+		c.waitFor(EventSession)
+		c.send(ClientMessage{Type: MessageCommand, Command: tc.app})
+		c.waitFor(EventAppStarted)
+
+		var data []byte
+		for deadline := time.Now().Add(5 * time.Second); len(data) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: the background process did not start", tc.app)
+			}
+			time.Sleep(10 * time.Millisecond)
+			data, _ = os.ReadFile(pidFile)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.disconnect {
+			c.conn.Close()
+		} else {
+			c.waitFor(EventAppExited)
+			c.conn.Close()
+		}
+		ts.waitIdle(t)
+
+		for deadline := time.Now().Add(2 * time.Second); processAlive(pid); {
+			if time.Now().After(deadline) {
+				syscall.Kill(pid, syscall.SIGKILL)
+				t.Fatalf("%s: process %d outlived the app", tc.app, pid)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// processAlive reports whether pid is running. Orphans may stay zombies when
+// nothing reaps them, which counts as gone.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name.
+	_, rest, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(rest, "Z")
+}
+
+// A client that disconnects while its launch is queued gives up its place, so
+// the slot is not handed to an app nobody is watching.
+func TestDetachLeavesQueue(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"hold": "exec sleep 30", "next": "exec sleep 30"}, func(c *TerminalConfig) {
+		c.MaxConcurrent = 1
+		c.MaxQueueLength = 5
+		c.ResumeGracePeriod = 2 * time.Minute
+	})
+	running := ts.dial(t, "")
+	running.waitFor(EventSession)
+	running.send(ClientMessage{Type: MessageCommand, Command: "hold"})
+	running.waitFor(EventAppStarted)
+
+	queued := ts.dial(t, "")
+	queued.waitFor(EventSession)
+	queued.send(ClientMessage{Type: MessageCommand, Command: "next"})
+	queued.waitFor(EventQueuePosition)
+	queued.conn.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ts.config.mu.Lock()
+		waiting, sessions := len(ts.config.waitQueue), len(ts.config.sessions)
+		ts.config.mu.Unlock()
+		if waiting == 0 && sessions == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d launches queued and %d sessions after the queued client left", waiting, sessions)
+		}
+	}
+
+	running.send(ClientMessage{Type: MessageSignal, Signal: "SIGTERM"})
+	running.waitFor(EventAppExited)
+	ts.config.mu.Lock()
+	jobs := ts.config.currentJobs
+	ts.config.mu.Unlock()
+	if jobs != 0 {
+		t.Errorf("%d job slots in use after the only app exited", jobs)
+	}
+
+	running.conn.Close()
+	ts.waitIdle(t)
+}
+
+// Shutdown reports the exit of a running app and then closes the connection
+// with 1012, after everything queued before it.
+func TestShutdownClosesAfterExitReport(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"wait": "exec sleep 30"}, nil)
+	c := ts.dial(t, "")
+	c.waitFor(EventSession)
+
+	c.send(ClientMessage{Type: MessageCommand, Command: "wait"})
+	c.waitFor(EventAppStarted)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go ts.config.Shutdown(ctx)
+
+	c.waitFor(EventShutdown)
+	c.waitFor(EventAppExited)
+	for {
+		_, err := c.next()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			if closeErr.Code != websocket.CloseServiceRestart {
+				t.Errorf("got close code %d, want %d", closeErr.Code, websocket.CloseServiceRestart)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+	}
+	ts.waitIdle(t)
+}
+
+// Clients that have stopped reading must not each add their close timeout
+// to the time shutdown takes.
+func TestShutdownClosesStalledClientsTogether(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"flood": "exec yes"}, func(c *TerminalConfig) {
+		c.Output.WriteTimeout = time.Minute
+	})
+	for range 5 {
+		c := ts.dial(t, "")
+		c.waitFor(EventSession)
+		c.send(ClientMessage{Type: MessageCommand, Command: "flood"})
+		c.waitFor(EventAppStarted)
+	}
+	// Stop reading until every writer is stuck.
+	time.Sleep(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ts.config.Shutdown(ctx)
+
+	// The apps exit on SIGTERM, after which exit reports and close frames
+	// share one exitReportTimeout and one close timeout.
+	if took := time.Since(start); took > exitReportTimeout+3*time.Second {
+		t.Errorf("shutdown took %s", took)
+	}
+	ts.waitIdle(t)
+}
+
+// Frames queued to a connection's writer go out in order, whichever
+// goroutine queued them.
+func TestConnWriterSerializesSenders(t *testing.T) {
+	received := make(chan []string, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		writer := newConnWriter(conn, time.Second, time.Minute, discardLogger())
+
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Go(func() {
+				for i := range 100 {
+					writer.send(websocket.TextMessage, []byte(strconv.Itoa(g)+":"+strconv.Itoa(i)))
+				}
+			})
+		}
+		wg.Wait()
+		writer.closeWith(websocket.CloseNormalClosure, "", time.Second)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		var frames []string
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				received <- frames
+				return
+			}
+			frames = append(frames, string(data))
+		}
+	}()
+
+	frames := <-received
+	if len(frames) != 800 {
+		t.Fatalf("got %d frames, want 800", len(frames))
+	}
+	last := make(map[string]int)
+	for _, frame := range frames {
+		g, i, _ := strings.Cut(frame, ":")
+		n, _ := strconv.Atoi(i)
+		if prev, ok := last[g]; ok && n != prev+1 {
+			t.Fatalf("sender %s: frame %d followed %d", g, n, prev)
+		}
+		last[g] = n
+	}
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
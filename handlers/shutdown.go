@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// jobPollInterval is how often Shutdown checks whether running apps are done.
+	jobPollInterval = 100 * time.Millisecond
+	// exitReportTimeout bounds the wait for exited apps' final output and
+	// app_exited events before sessions are closed.
+	exitReportTimeout = 2 * time.Second
+)
+
+// Shutdown drains the terminal for a restart. New connections and launches
+// are refused and queued launches are cancelled. Connected sessions are told
+// the server is going away, and running apps get until ctx is done to finish
+// on their own. The process groups of apps still running then get SIGTERM
+// and, after a short grace period, SIGKILL, before every session is closed.
+func (c *TerminalConfig) Shutdown(ctx context.Context) {
+	c.mu.Lock()
+	c.shuttingDown = true
+	queued := c.waitQueue
+	c.waitQueue = nil
+	sessions := c.sessionList()
+	c.mu.Unlock()
+
+	grace := time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		grace = max(time.Until(deadline), 0)
+	}
+	slog.Info("Draining terminal sessions", "sessions", len(sessions), "queued", len(queued), "grace_period", grace)
+
+	for _, launch := range queued {
+		launch.session.sendError(ErrShuttingDown, fmt.Sprintf("The server is restarting, %s was not started", launch.appName))
+	}
+	for _, s := range sessions {
+		s.notifyShutdown(grace)
+	}
+
+	if !c.waitForJobs(ctx) {
+		// Sessions that attached while the flag was being set are caught here.
+		c.mu.Lock()
+		sessions = c.sessionList()
+		c.mu.Unlock()
+
+		if !c.stopApps(sessions, syscall.SIGTERM, terminateGracePeriod) {
+			c.stopApps(sessions, syscall.SIGKILL, time.Second)
+		}
+	}
+
+	c.mu.Lock()
+	sessions = c.sessionList()
+	c.mu.Unlock()
+	// Sessions are closed side by side, so stalled clients each cost at most
+	// the close frame's timeout once rather than one after another.
+	deadline := time.Now().Add(exitReportTimeout)
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Go(func() {
+			s.awaitExitReport(time.Until(deadline))
+			s.closeForShutdown()
+		})
+	}
+	wg.Wait()
+	slog.Info("Terminal sessions closed", "sessions", len(sessions))
+}
+
+// stopApps signals every running app and waits up to timeout for them to
+// exit, which lets their sessions report the exit before they are closed.
+func (c *TerminalConfig) stopApps(sessions []*TerminalSession, sig syscall.Signal, timeout time.Duration) bool {
+	for _, s := range sessions {
+		s.signalApp(sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.waitForJobs(ctx)
+}
+
+func (c *TerminalConfig) isShuttingDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.shuttingDown
+}
+
+// sessionList must be called with c.mu held.
+func (c *TerminalConfig) sessionList() []*TerminalSession {
+	sessions := make([]*TerminalSession, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// waitForJobs reports whether every job slot was freed before ctx was done.
+func (c *TerminalConfig) waitForJobs(ctx context.Context) bool {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		c.mu.Lock()
+		running := c.currentJobs
+		c.mu.Unlock()
+		if running == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *TerminalSession) notifyShutdown(grace time.Duration) {
+	s.mu.Lock()
+	running := s.cmd != nil
+	s.mu.Unlock()
+
+	message := "The server is restarting. Please reconnect in a moment."
+	if running {
+		seconds := int(math.Ceil(grace.Seconds()))
+		message = fmt.Sprintf("The server is restarting. The running app will be closed in %ds.", seconds)
+		s.sendBanner(" " + message + " ")
+	} else {
+		s.sendOutput("\r\n" + message + "\r\n")
+	}
+
+	s.sendEvent(ShutdownEvent{
+		Type:          EventShutdown,
+		Message:       message,
+		GracePeriodMs: grace.Milliseconds(),
+	})
+}
+
+func (s *TerminalSession) signalApp(sig syscall.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.log.Info("Stopping app for shutdown", "signal", sig.String())
+		signalGroup(s.cmd, sig)
+	}
+}
+
+// awaitExitReport waits up to timeout for the session's app, if any, to be
+// reported as exited to the client.
+func (s *TerminalSession) awaitExitReport(timeout time.Duration) {
+	s.mu.Lock()
+	reported := s.exitReported
+	s.mu.Unlock()
+
+	if reported == nil {
+		return
+	}
+	select {
+	case <-reported:
+	case <-time.After(timeout):
+	}
+}
+
+// closeForShutdown tells the client the server is restarting, so it knows to
+// reconnect, and tears the session down.
+func (s *TerminalSession) closeForShutdown() {
+	s.mu.Lock()
+	writer := s.writer
+	s.mu.Unlock()
+
+	if writer != nil {
+		writer.closeWith(websocket.CloseServiceRestart, "server restarting", time.Second)
+	}
+
+	s.close()
+	s.log.Info("Session closed for shutdown")
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log/slog"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// hangupGracePeriod is how long an app gets to exit after the SIGHUP that
+// starts the escalation when its session goes away.
+const hangupGracePeriod = 2 * time.Second
+
+// clientSignals are the signals a client may send to the running app.
+var clientSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+}
+
+// signalGroup signals the app and everything it started. pty.Start runs the
+// app in a new session, so its PID is also its process group ID.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		cmd.Process.Signal(sig)
+	}
+}
+
+// reapGroup kills whatever the app left running once it has exited, however
+// it ended, so that escalating signals stops at the leader's exit but still
+// reaches the rest of the group. A process group outlives its leader while any
+// member is alive, so its ID cannot have been reused. The app's cgroup, when
+// it has one, also catches processes that left the group with setsid.
+func reapGroup(logger *slog.Logger, cmd *exec.Cmd, cg *appCgroup) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err == nil {
+		logger.Info("Killed processes the app left running", "pgid", cmd.Process.Pid)
+	}
+	cg.kill()
+}
+
+// stopApp hangs up on the app the way a closed terminal would, then sends
+// SIGTERM, and kills its process group if it is still running after that.
+func stopApp(cmd *exec.Cmd, exited <-chan struct{}) {
+	steps := []struct {
+		sig  syscall.Signal
+		wait time.Duration
+	}{
+		{syscall.SIGHUP, hangupGracePeriod},
+		{syscall.SIGTERM, terminateGracePeriod},
+	}
+	for _, step := range steps {
+		signalGroup(cmd, step.sig)
+		select {
+		case <-exited:
+			return
+		case <-time.After(step.wait):
+		}
+	}
+	signalGroup(cmd, syscall.SIGKILL)
+}
+
+func (s *TerminalSession) handleSignal(name string) {
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	if cmd == nil {
+		s.sendError(ErrNotRunning, "No app is running")
+		return
+	}
+	s.log.Info("Signalling app", "signal", name)
+	signalGroup(cmd, clientSignals[name])
+}
@@ -1,112 +1,269 @@
 package handlers
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
 )
 
 type TerminalConfig struct {
-	AppsDirectory  string
-	AllowedApps    map[string]string
-	AllowedOrigins map[string]bool
-	MaxConcurrent  int
-	currentJobs    int
-	mu             sync.Mutex
+	AppsDirectory       string
+	DiscoverApps        bool
+	Apps                map[string]AppManifest
+	AllowedOrigins      map[string]bool
+	MaxConcurrent       int
+	MaxQueueLength      int
+	ResumeGracePeriod   time.Duration
+	ScrollbackSize      int
+	RecordingsDirectory string
+	MaxRecordings       int
+	CgroupParent        string
+	ShutdownTimeout     time.Duration // how long running apps may take to finish on shutdown; not reloaded
+	SigningKeys         []ed25519.PublicKey
+	RequireSignatures   bool
+	Metrics             *Metrics
+	Output              OutputConfig
+	WebSocket           WebSocketConfig
+	RateLimits          RateLimits
+	limiter             rateLimiter
+	pins                map[string]string // executable digests pinned since startup, by app; never reloaded
+	currentJobs         int
+	sessions            map[string]*TerminalSession
+	waitQueue           []*queuedLaunch
+	cgroupOnce          sync.Once
+	cgroupPath          string
+	shuttingDown        bool
+	mu                  sync.Mutex
 }
 
+// ptyDrainTimeout bounds how long an exited app's remaining output is awaited.
+const ptyDrainTimeout = 250 * time.Millisecond
+
+// SessionIDKey is the echo.Context key under which HandleWebSocket stores the
+// session ID, so request logging can tie the upgrade to the session.
+const SessionIDKey = "session_id"
+
+// TerminalSession is one client's terminal. It outlives a dropped connection
+// while an app is running, so the client can resume it.
+//
+// The first group of fields is set when the session is created and never
+// changes. The editor belongs to whoever holds inputMu, which the read loop
+// takes for each message. Everything else is guarded by mu. The connection
+// is only ever written by writer, so sending never touches it directly.
+//
+// Senders hold sendMu while they build frames under mu and, after releasing
+// mu, queue them to the writer, which may wait for a slow client. sendMu is
+// taken after inputMu and before mu, and never with config.mu held.
 type TerminalSession struct {
-	conn      *websocket.Conn
-	mu        sync.Mutex
-	ptmx      *os.File
-	cmd       *exec.Cmd
-	done      chan bool
-	cmdBuffer string
-	closed    bool
-	config    *TerminalConfig
+	id     string
+	token  string
+	config *TerminalConfig
+	log    *slog.Logger
+	output *outputPipeline
+
+	inputMu sync.Mutex
+	editor  *lineEditor
+
+	sendMu sync.Mutex
+
+	mu           sync.Mutex
+	writer       *connWriter // nil while detached
+	protocol     protocolOptions
+	closed       bool
+	scrollback   *ringBuffer
+	detachTimer  *time.Timer
+	ptmx         *os.File
+	cmd          *exec.Cmd
+	recorder     *recorder
+	lastActivity time.Time
+	stopReason   string
+	stopMessage  string
+	exited       chan struct{} // closed when the running app has exited
+	exitReported chan struct{} // closed once the running app's exit has been sent
+	runs         []runRecord
+	runCount     int
+	terminal     clientTerminal // the client's terminal, used to start apps
 }
 
 func HandleWebSocket(config *TerminalConfig) echo.HandlerFunc {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("origin")
-			return config.AllowedOrigins[origin]
+			return config.OriginAllowed(r.Header.Get("origin"))
 		},
+		Subprotocols: serverSubprotocols,
 	}
 	return func(c echo.Context) error {
+		requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+		if config.isShuttingDown() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{
+				"error": "Server is shutting down",
+			})
+		}
+
+		if delay, limit := config.limitRequest(endpointWebSocket, c.Request()); delay > 0 {
+			slog.Info("WebSocket connection rate limited", "request_id", requestID, "remote_ip", c.RealIP(), "limit", limit, "retry_after", delay)
+			return refuseConnection(c, &upgrader, websocket.CloseTryAgainLater, "Too many connections, try again in "+retryAfter(delay)+"s", delay)
+		}
+		release, ok := config.openSession(c.Request())
+		if !ok {
+			slog.Info("Too many sessions from one address", "request_id", requestID, "remote_ip", c.RealIP())
+			return refuseConnection(c, &upgrader, websocket.ClosePolicyViolation, "Too many open terminals from your address", 0)
+		}
+		defer release()
+
 		conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 		if err != nil {
-			log.Println("Upgrade error:", err)
+			slog.Warn("WebSocket upgrade failed", "request_id", requestID, "error", err)
 			return err
 		}
 		defer conn.Close()
 
-		log.Printf("New WebSocket connection from: %s", c.Request().RemoteAddr)
-
-		session := &TerminalSession{
-			conn:   conn,
-			done:   make(chan bool),
-			closed: false,
-			config: config,
+		config.Metrics.connectionOpened()
+		defer config.Metrics.connectionClosed()
+
+		wsConfig := config.webSocketConfig()
+		wsConfig.watchReads(conn)
+
+		protocol := negotiateProtocol(conn.Subprotocol())
+		session, resumed := config.attachSession(c.QueryParam("resume"), conn, protocol, wsConfig.PingInterval)
+		// Lets the request log line for this upgrade carry the session ID.
+		c.Set(SessionIDKey, session.id)
+
+		logger := session.log.With("request_id", requestID)
+		logger.Info("WebSocket connected",
+			"remote_ip", c.RealIP(),
+			"protocol", protocol.version,
+			"binary_output", protocol.binaryOutput,
+			"resumed", resumed)
+
+		// A resumed session was sent its token and scrollback by attach.
+		if !resumed {
+			session.sendResumeToken()
+			session.inputMu.Lock()
+			session.sendWelcome()
+			session.editor.showPrompt()
+			session.inputMu.Unlock()
 		}
-		session.sendWelcome()
 
 		for {
-			var msg map[string]any
-			err := conn.ReadJSON(&msg)
+			_, data, err := conn.ReadMessage()
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket error: %v", err)
+				var netErr net.Error
+				switch {
+				case errors.Is(err, websocket.ErrReadLimit):
+					logger.Warn("WebSocket message too large, closing", "max_message_size", wsConfig.MaxMessageSize)
+				case errors.As(err, &netErr) && netErr.Timeout():
+					logger.Info("WebSocket peer stopped responding, closing")
+				case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure):
+					logger.Warn("WebSocket read failed", "error", err)
 				}
 				break
 			}
+			wsConfig.extendDeadline(conn)
 
-			if command, ok := msg["command"].(string); ok && command != "" {
-				session.handleCommand(command)
-			} else if input, ok := msg["input"].(string); ok {
-				session.handleInput(input)
-			} else if resize, ok := msg["resize"].(map[string]any); ok {
-				session.handleResize(resize)
+			msg, err := decodeClientMessage(data, protocol.version)
+			if err != nil {
+				session.sendEvent(ErrorEvent{Type: EventError, Code: ErrInvalidMessage, Message: err.Error()})
+				continue
 			}
+
+			session.handleMessage(msg)
 		}
 
-		session.cleanup()
-		log.Println("WebSocket connection closed")
+		// Fails a write still in progress, so detaching does not wait for it.
+		conn.Close()
+		session.detach(conn)
+		logger.Info("WebSocket closed")
 		return nil
 	}
 }
 
+// refuseConnection turns a throttled client away. A browser cannot see the
+// status of a failed upgrade, so WebSocket requests are upgraded and then
+// closed with code; anything else gets a 429.
+func refuseConnection(c echo.Context, upgrader *websocket.Upgrader, code int, message string, wait time.Duration) error {
+	header := http.Header{}
+	if wait > 0 {
+		header.Set("Retry-After", retryAfter(wait))
+	}
+	if !websocket.IsWebSocketUpgrade(c.Request()) {
+		for name, values := range header {
+			c.Response().Header()[name] = values
+		}
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": message})
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), header)
+	if err != nil {
+		return err
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, message), time.Now().Add(time.Second))
+	return conn.Close()
+}
+
+// handleMessage runs one client message. Messages are handled one at a time
+// even across connections, so a stale read loop still busy with a message
+// when the client reconnects cannot race the new one.
+func (s *TerminalSession) handleMessage(msg ClientMessage) {
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+
+	switch msg.Type {
+	case MessageCommand:
+		s.handleCommand(msg.Command)
+	case MessageInput:
+		s.handleInput(msg.Data)
+	case MessageResize:
+		s.handleResize(msg.Rows, msg.Cols, msg.PixelWidth, msg.PixelHeight)
+	case MessageHello:
+		s.handleHello(msg.terminal())
+	case MessageSignal:
+		s.handleSignal(msg.Signal)
+	}
+}
+
 func (s *TerminalSession) sendWelcome() {
 	welcome := `Welcome to the Terminal Showcase!
 
 Available apps:
 `
-	for app, desc := range s.config.AllowedApps {
-		welcome += fmt.Sprintf("  %s - %s\n", app, desc)
-	}
+	welcome += s.config.appsText()
 	welcome += `
 Commands:
   <app-name> [args]  - Run an app
   list               - List available apps
   help               - Show this message
+  clear              - Clear the screen
+  history [run]      - Show the apps run in this session
+
+Tab completes commands and app names; Up and Down recall earlier commands.
 
 `
 	s.sendOutput(welcome)
 }
 
 func (s *TerminalSession) handleCommand(command string) {
-	parts := strings.Fields(command)
+	parts, err := splitCommand(command)
+	if err != nil {
+		s.sendError(ErrInvalidCommand, "Could not parse command: "+err.Error())
+		return
+	}
 	if len(parts) == 0 {
 		return
 	}
@@ -121,6 +278,9 @@ func (s *TerminalSession) handleCommand(command string) {
 	case "clear":
 		s.sendRawOutput([]byte("\x1b[2J\x1b[H"))
 		return
+	case "history":
+		s.showHistory(parts[1:])
+		return
 	}
 
 	s.executeApp(parts[0], parts[1:])
@@ -129,114 +289,357 @@ func (s *TerminalSession) handleCommand(command string) {
 func (s *TerminalSession) handleInput(input string) {
 	s.mu.Lock()
 	ptmx := s.ptmx
+	rec := s.recorder
 	s.mu.Unlock()
 
-	if ptmx != nil {
-		_, err := ptmx.Write([]byte(input))
-		if err != nil {
-			log.Printf("Error writing to PTY: %v", err)
+	if ptmx == nil {
+		// Whatever follows a line that launched an app is meant for the app.
+		if input = s.editor.feed(input); input == "" {
+			return
+		}
+		s.mu.Lock()
+		ptmx = s.ptmx
+		rec = s.recorder
+		s.mu.Unlock()
+		if ptmx == nil {
+			return
 		}
-		return
 	}
 
-	for _, char := range input {
-		switch char {
-		case '\r', '\n':
-			s.sendRawOutput([]byte("\r\n"))
-			if len(s.cmdBuffer) > 0 {
-				s.handleCommand(s.cmdBuffer)
-				s.cmdBuffer = ""
-			}
-		case 127, 8:
-			if len(s.cmdBuffer) > 0 {
-				s.cmdBuffer = s.cmdBuffer[:len(s.cmdBuffer)-1]
-				s.sendRawOutput([]byte("\b \b"))
-			}
-		case 3:
-			s.sendRawOutput([]byte("^C\r\n"))
-			s.cmdBuffer = ""
-		default:
-			s.cmdBuffer += string(char)
-			s.sendRawOutput([]byte(string(char)))
-		}
+	s.touch()
+	rec.input(input)
+	n, err := ptmx.Write([]byte(input))
+	s.config.Metrics.ptyInput(n)
+	if err != nil {
+		s.log.Warn("PTY write failed", "error", err)
 	}
 }
 
-func (s *TerminalSession) listApps() {
-	output := "Available apps:\n"
-	for app, desc := range s.config.AllowedApps {
-		output += fmt.Sprintf("  %s - %s\n", app, desc)
-	}
-	s.sendOutput(output)
+// runLine runs a line entered at the prompt and reports whether the prompt
+// should come back, which it does not while an app runs or a launch waits.
+func (s *TerminalSession) runLine(line string) bool {
+	s.handleCommand(line)
+
+	s.mu.Lock()
+	running := s.ptmx != nil
+	s.mu.Unlock()
+	return !running && !s.config.isQueued(s)
 }
 
-func (s *TerminalSession) executeApp(appName string, args []string) {
-	if !s.config.acquireJob() {
-		s.sendOutput("Error: An app is already running. Please wait.\n")
-		return
+func (s *TerminalSession) interruptLine() {
+	if s.config.cancelQueued(s) {
+		s.sendOutput("Left the queue\r\n")
 	}
-	defer s.config.releaseJob()
+}
+
+func (s *TerminalSession) listApps() {
+	s.sendOutput("Available apps:\n" + s.config.appsText())
+}
 
-	description, allowed := s.config.AllowedApps[appName]
+func (s *TerminalSession) executeApp(appName string, args []string) {
+	app, appPath, allowed := s.config.app(appName)
 	if !allowed {
-		s.sendOutput(fmt.Sprintf("Error: App '%s' not found\n", appName))
+		s.rejectLaunch(ErrAppNotFound, fmt.Sprintf("App '%s' not found", appName))
 		s.sendOutput("Type 'list' to see available apps\n")
 		return
 	}
 
-	appPath := filepath.Join(s.config.AppsDirectory, appName)
+	if err := app.Args.check(args); err != nil {
+		s.rejectLaunch(ErrInvalidArguments, fmt.Sprintf("%s: %v", appName, err))
+		return
+	}
 
 	if _, err := os.Stat(appPath); os.IsNotExist(err) {
-		s.sendOutput(fmt.Sprintf("Error: App '%s' executable not found at %s\n", appName, appPath))
+		s.rejectLaunch(ErrExecutableMissing, fmt.Sprintf("App '%s' executable not found at %s", appName, appPath))
 		s.sendOutput("Make sure to compile and place your app in the terminal-apps directory\n")
 		return
 	}
 
-	log.Printf("Running app: %s (%s) with args: %v", appName, description, args)
+	if s.config.isShuttingDown() {
+		s.rejectLaunch(ErrShuttingDown, "The server is restarting. Please reconnect in a moment.")
+		return
+	}
+
+	if s.config.isQueued(s) {
+		s.rejectLaunch(ErrAlreadyQueued, "Already waiting in the queue. Press Ctrl+C to cancel.")
+		return
+	}
+
+	acquired, position := s.config.reserveJob(s, appName, args)
+	if !acquired {
+		if position == 0 && s.config.queueEnabled() {
+			s.rejectLaunch(ErrQueueFull, "The queue is full. Please try again later.")
+			return
+		}
+		if position == 0 {
+			s.rejectLaunch(ErrBusy, "An app is already running. Please wait.")
+			return
+		}
+		s.sendQueuePosition(appName, position, position)
+		return
+	}
+
+	s.startApp(appName, args)
+}
+
+// startApp launches an app in a job slot the caller has already reserved.
+func (s *TerminalSession) startApp(appName string, args []string) {
+	// The job slot is held until the app exits; only failed launches give it back here.
+	started := false
+	defer func() {
+		if !started {
+			s.config.releaseJob(s.log)
+		}
+	}()
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return
+	}
+
+	// The app may have been removed by a reload while the launch was queued.
+	app, appPath, ok := s.config.app(appName)
+	if !ok {
+		s.rejectLaunch(ErrAppNotFound, fmt.Sprintf("App '%s' not found", appName))
+		return
+	}
+	if err := app.Args.check(args); err != nil {
+		s.rejectLaunch(ErrInvalidArguments, fmt.Sprintf("%s: %v", appName, err))
+		return
+	}
+
+	exe, err := s.config.openVerified(s.log, appName, appPath, app)
+	if err != nil {
+		s.log.Error("Refusing to run app", "app", appName, "error", err)
+		s.rejectLaunch(ErrVerificationFailed, fmt.Sprintf("App '%s' failed integrity verification and will not run", appName))
+		return
+	}
+	// The app has its own copy of the descriptor once it has started.
+	defer exe.Close()
+
+	s.log.Info("Running app", "app", appName, "args", args)
 	s.sendOutput(fmt.Sprintf("Running: %s\n", appName))
 
+	limits := app.Limits
+	cg, err := s.config.newAppCgroup(limits)
+	if err != nil {
+		s.log.Warn("Creating cgroup failed, using rlimits only", "app", appName, "error", err)
+	}
+
 	cmd := exec.Command(appPath, args...)
+	execVerified(cmd, exe)
+	cmd.Dir = app.WorkingDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cg.apply(cmd.SysProcAttr)
 
-	cmd.Env = append(os.Environ(),
-		"TERM=xterm-256color",
-		"COLORTERM=truecolor",
-		"TERM_PROGRAM=",
-	)
+	sb, err := applySandbox(cmd, app.Sandbox)
+	if err != nil {
+		s.log.Error("Preparing sandbox failed", "app", appName, "error", err)
+		cg.remove()
+		s.rejectLaunch(ErrLaunchFailed, "Failed to prepare app sandbox")
+		return
+	}
 
-	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{
-		Rows: 30,
-		Cols: 120,
-	})
+	s.mu.Lock()
+	term := s.terminal
+	s.mu.Unlock()
+	cmd.Env = appEnv(app.Env, term, appName, s.id)
+	size := term.winsize(app.Size)
+	// With StderrTail, stderr goes through a pipe rather than the PTY so
+	// the end of it can be kept for the exit report; it is still shown in the
+	// terminal. Otherwise pty.StartWithSize puts it on the PTY.
+	var stderr, stderrW *os.File
+	if app.StderrTail {
+		stderr, stderrW, err = os.Pipe()
+		if err != nil {
+			sb.started()
+			sb.release()
+			cg.remove()
+			s.rejectLaunch(ErrLaunchFailed, fmt.Sprintf("Failed to start app: %v", err))
+			return
+		}
+		cmd.Stderr = stderrW
+	}
+
+	ptmx, err := pty.StartWithSize(cmd, size)
+	sb.started()
+	if stderrW != nil {
+		stderrW.Close()
+	}
 	if err != nil {
-		s.sendOutput(fmt.Sprintf("Error starting app: %v\n", err))
+		if stderr != nil {
+			stderr.Close()
+		}
+		sb.release()
+		cg.remove()
+		s.rejectLaunch(ErrLaunchFailed, fmt.Sprintf("Failed to start app: %v", err))
+		return
+	}
+
+	if err := applyRlimits(cmd.Process.Pid, limits); err != nil {
+		s.log.Error("Applying resource limits failed", "app", appName, "error", err)
+		cmd.Process.Kill()
+		sb.release()
+		cmd.Wait()
+		ptmx.Close()
+		if stderr != nil {
+			stderr.Close()
+		}
+		cg.remove()
+		s.rejectLaunch(ErrLaunchFailed, "Failed to apply resource limits")
 		return
 	}
+	sb.release()
+	started = true
+
+	var rec *recorder
+	if app.Record {
+		rec = s.config.startRecording(s.log, appName, app.RecordInput, int(size.Cols), int(size.Rows), map[string]string{
+			"TERM":  envValue(cmd.Env, "TERM"),
+			"SHELL": "",
+		})
+	}
 
+	startedAt := time.Now()
+	s.config.Metrics.appLaunched(appName)
+	exited := make(chan struct{})
+	exitReported := make(chan struct{})
 	s.mu.Lock()
-	s.ptmx = ptmx
-	s.cmd = cmd
+	// The session may have closed while the app was being started, after the
+	// check above. Nothing would stop the app then, so stop it here; its exit
+	// handler below still gives back the job slot and cleans up.
+	closed = s.closed
+	if !closed {
+		s.ptmx = ptmx
+		s.cmd = cmd
+		s.recorder = rec
+		s.exited = exited
+		s.exitReported = exitReported
+		s.lastActivity = startedAt
+		s.stopReason = ""
+		s.stopMessage = ""
+	}
 	s.mu.Unlock()
+	if closed {
+		s.log.Info("Session closed while the app was starting, stopping it", "app", appName)
+		go stopApp(cmd, exited)
+	}
+
+	s.sendEvent(AppStartedEvent{
+		Type: EventAppStarted,
+		App:  appName,
+		Args: args,
+		Rows: int(size.Rows),
+		Cols: int(size.Cols),
+	})
 
-	go s.handlePtyOutput(ptmx)
+	readerDone := make(chan struct{})
+	go func() {
+		s.handlePtyOutput(ptmx, rec)
+		close(readerDone)
+	}()
+	stderrDone := make(chan struct{})
+	stderrLines := &stderrTail{}
+	if stderr != nil {
+		go func() {
+			s.forwardStderr(stderr, rec, stderrLines)
+			close(stderrDone)
+		}()
+	} else {
+		close(stderrDone)
+	}
+	go s.watchApp(appName, cmd, app.Timeouts, exited)
 
 	go func() {
-		err = cmd.Wait()
+		defer close(exitReported)
+		cmd.Wait()
+		reapGroup(s.log, cmd, cg)
+		close(exited)
+		s.config.releaseJob(s.log)
+
+		// Let the last of the app's output reach the client before reporting the
+		// exit. A background process still holding the PTY or stderr open would
+		// keep the readers going forever, so only wait a moment for them.
+		drainDeadline := time.Now().Add(ptyDrainTimeout)
+		for _, done := range []chan struct{}{readerDone, stderrDone} {
+			select {
+			case <-done:
+			case <-time.After(time.Until(drainDeadline)):
+			}
+		}
+		s.output.drain()
 
 		s.mu.Lock()
+		ptmx.Close()
 		s.ptmx = nil
 		s.cmd = nil
+		if s.recorder == rec {
+			s.recorder = nil
+		}
+		stopReason, stopMessage := s.stopReason, s.stopMessage
 		s.mu.Unlock()
 
-		if err != nil {
-			log.Printf("App exited with error: %v\n", err)
+		s.config.finishRecording(s.log, rec)
+
+		violation := limitViolation(cmd.ProcessState, limits, cg, sb != nil)
+		cg.remove()
+		if violation != "" {
+			s.log.Warn("App exceeded a resource limit", "app", appName, "violation", violation)
+			s.sendOutput(fmt.Sprintf("\r\n[%s was stopped: %s]\r\n", appName, violation))
+			stopReason, stopMessage = terminatedLimit, violation
 		}
 
-		s.sendOutput("\r\n[Process Completed. Press Enter to continue]\r\n")
+		exitCode := cmd.ProcessState.ExitCode()
+		signal := ""
+		if sig, ok := exitSignal(cmd.ProcessState, sb != nil); ok {
+			exitCode = 128 + int(sig)
+			signal = unix.SignalName(sig)
+		}
+		duration := time.Since(startedAt)
+		s.log.Info("App exited",
+			"app", appName,
+			"exit_code", exitCode,
+			"signal", signal,
+			"duration", duration,
+			"reason", stopReason)
+		s.config.Metrics.appExited(appName, exitCode, duration)
+
+		run := runRecord{
+			App:            appName,
+			Args:           args,
+			StartedAt:      startedAt,
+			Duration:       duration,
+			ExitCode:       exitCode,
+			Signal:         signal,
+			Reason:         stopReason,
+			Message:        stopMessage,
+			StderrCaptured: stderr != nil,
+			Stderr:         stderrLines.tail(),
+		}
+		runNumber := s.recordRun(run)
+		s.sendEvent(AppExitedEvent{
+			Type:       EventAppExited,
+			App:        appName,
+			Run:        runNumber,
+			ExitCode:   exitCode,
+			Signal:     signal,
+			DurationMs: duration.Milliseconds(),
+			Reason:     stopReason,
+			Message:    stopMessage,
+			Stderr:     run.Stderr,
+		})
+
+		s.sendOutput(fmt.Sprintf("\r\n[%s %s after %s. Press Enter to continue]\r\n", appName, run.result(), formatRuntime(duration)))
 	}()
 }
 
-func (s *TerminalSession) handlePtyOutput(ptmx *os.File) {
+func (s *TerminalSession) handlePtyOutput(ptmx *os.File, rec *recorder) {
 	buf := make([]byte, 8192)
+	// pending holds an incomplete UTF-8 sequence from the end of the previous
+	// read so that JSON encoding never splits a rune into U+FFFD.
+	var pending []byte
 	for {
 		s.mu.Lock()
 		closed := s.closed
@@ -248,132 +651,238 @@ func (s *TerminalSession) handlePtyOutput(ptmx *os.File) {
 
 		n, err := ptmx.Read(buf)
 		if err != nil {
+			if len(pending) > 0 {
+				rec.output(pending)
+				s.output.write(pending)
+			}
 			if err != io.EOF {
-				log.Printf("PTY read error: %v", err)
+				s.log.Debug("PTY read ended", "error", err)
 			}
 			return
 		}
 		if n > 0 {
-			s.sendRawOutput(buf[:n])
+			s.config.Metrics.ptyOutput(n)
+			s.touch()
+			data := append(pending, buf[:n]...)
+			complete := len(data) - incompleteUTF8Tail(data)
+			pending = append([]byte(nil), data[complete:]...)
+			if complete == 0 {
+				continue
+			}
+			rec.output(data[:complete])
+			s.output.write(data[:complete])
 		}
 	}
 }
 
-func (s *TerminalSession) handleResize(resize map[string]any) {
+// handleHello records what the client reported about its terminal. Apps
+// launched from now on start with its size and capabilities.
+func (s *TerminalSession) handleHello(term clientTerminal) {
 	s.mu.Lock()
-	ptmx := s.ptmx
+	if term.Rows == 0 {
+		// Keep a size from an earlier resize.
+		term.Rows, term.Cols = s.terminal.Rows, s.terminal.Cols
+		term.PixelWidth, term.PixelHeight = s.terminal.PixelWidth, s.terminal.PixelHeight
+	}
+	s.terminal = term
 	s.mu.Unlock()
 
-	if ptmx == nil {
-		return
-	}
-	rows, rowsOk := resize["rows"].(float64)
-	cols, colsOk := resize["cols"].(float64)
+	s.log.Debug("Client terminal reported",
+		"rows", term.Rows,
+		"cols", term.Cols,
+		"pixel_width", term.PixelWidth,
+		"pixel_height", term.PixelHeight,
+		"color_depth", term.ColorDepth,
+		"term", term.Term,
+		"locale", term.Locale)
+}
 
-	if !rowsOk || !colsOk {
+func (s *TerminalSession) handleResize(rows, cols, pixelWidth, pixelHeight int) {
+	if rows <= 0 || cols <= 0 {
 		return
 	}
 
-	newRows := uint16(rows)
-	newCols := uint16(cols)
-
-	currentSize, err := pty.GetsizeFull(ptmx)
-	if err == nil {
-		if currentSize.Rows == newRows && currentSize.Cols == newCols {
-			return
-		}
-	}
-
-	err = pty.Setsize(ptmx, &pty.Winsize{
+	newSize := &pty.Winsize{
 		Rows: uint16(rows),
 		Cols: uint16(cols),
-	})
-	if err != nil {
-		log.Printf("Error resizing PTY: %v", err)
+		X:    uint16(pixelWidth),
+		Y:    uint16(pixelHeight),
 	}
-}
 
-func (s *TerminalSession) sendRawOutput(data []byte) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	// The next app starts at this size even if none is running now.
+	s.terminal.Rows, s.terminal.Cols = rows, cols
+	s.terminal.PixelWidth, s.terminal.PixelHeight = pixelWidth, pixelHeight
+	rec := s.recorder
+	if s.ptmx == nil {
+		s.mu.Unlock()
+		return
+	}
+	// The PTY is resized under mu because the app's exit handler closes it
+	// under mu, and its descriptor must not be used once closed.
+	resized, err := resizePty(s.ptmx, newSize)
+	s.mu.Unlock()
 
-	msg := map[string]string{"output": string(data)}
-	jsonData, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
+		s.log.Warn("PTY resize failed", "error", err)
 		return
 	}
+	if resized {
+		rec.resize(newSize.Cols, newSize.Rows)
+		s.config.Metrics.resized()
+	}
+	s.sendEvent(ResizeAckEvent{Type: EventResizeAck, Rows: rows, Cols: cols})
+}
 
-	if err := s.conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-		log.Printf("Write error: %v", err)
+// resizePty sets the PTY's size, reporting false when it already had it.
+func resizePty(ptmx *os.File, size *pty.Winsize) (bool, error) {
+	if current, err := pty.GetsizeFull(ptmx); err == nil && *current == *size {
+		return false, nil
 	}
+	if err := pty.Setsize(ptmx, size); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (s *TerminalSession) sendOutput(output string) {
-	msg := map[string]string{"output": output}
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
+// send queues the frames built by frames, which runs with mu held, to the
+// connection's writer once mu is released. A full queue then only holds up
+// other senders, which wait on sendMu so frames keep the order they were
+// built in.
+func (s *TerminalSession) send(frames func() []outboundFrame) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	out := frames()
+	writer := s.writer
+	s.mu.Unlock()
+
+	if writer == nil {
 		return
 	}
+	for _, frame := range out {
+		writer.send(frame.messageType, frame.data)
+	}
+}
+
+func (s *TerminalSession) sendRawOutput(data []byte) {
+	s.send(func() []outboundFrame {
+		s.scrollback.Write(data)
+		return s.outputFramesLocked(data)
+	})
+}
+
+func (s *TerminalSession) outputFramesLocked(data []byte) []outboundFrame {
+	if s.writer == nil {
+		return nil
+	}
 
-	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		log.Printf("Write error: %v", err)
+	if s.protocol.binaryOutput {
+		return []outboundFrame{{websocket.BinaryMessage, data}}
 	}
+	return s.eventFramesLocked(OutputEvent{Type: EventOutput, Data: string(data)})
+}
+
+func (s *TerminalSession) sendOutput(output string) {
+	s.sendRawOutput([]byte(output))
 }
 
-func (c *TerminalConfig) acquireJob() bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// sendError shows the message in the terminal and, for v2 clients, also
+// sends it as a structured error event.
+func (s *TerminalSession) sendError(code, message string) {
+	s.sendOutput("Error: " + message + "\n")
+	s.sendEvent(ErrorEvent{Type: EventError, Code: code, Message: message})
+}
 
-	if c.currentJobs >= c.MaxConcurrent {
-		return false
+func (s *TerminalSession) rejectLaunch(code, message string) {
+	s.config.Metrics.launchRejected(code)
+	s.sendError(code, message)
+}
+
+func (s *TerminalSession) sendEvent(event serverEvent) {
+	s.send(func() []outboundFrame {
+		return s.eventFramesLocked(event)
+	})
+}
+
+func (s *TerminalSession) eventFramesLocked(event serverEvent) []outboundFrame {
+	if s.writer == nil {
+		return nil
 	}
-	c.currentJobs++
-	log.Printf("App started. Running apps: %d/%d", c.currentJobs, c.MaxConcurrent)
-	return true
+
+	var msg any = event
+	if s.protocol.version != ProtocolV2 {
+		if msg = event.legacy(); msg == nil {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.log.Error("Encoding event failed", "error", err)
+		return nil
+	}
+	return []outboundFrame{{websocket.TextMessage, data}}
 }
 
 func (s *TerminalSession) cleanup() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.cleanupLocked()
+	s.mu.Unlock()
 
+	s.output.close()
+}
+
+func (s *TerminalSession) cleanupLocked() {
 	s.closed = true
 
-	if s.ptmx != nil {
-		s.ptmx.Close()
-		s.ptmx = nil
+	if s.writer != nil {
+		s.writer.close()
+		s.writer = nil
+	}
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
 	}
 
+	// The app's exit handler closes the PTY once the app is gone.
+	s.ptmx = nil
 	if s.cmd != nil && s.cmd.Process != nil {
-		s.cmd.Process.Kill()
+		go stopApp(s.cmd, s.exited)
 		s.cmd = nil
 	}
 }
 
-func (c *TerminalConfig) releaseJob() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.currentJobs > 0 {
-		c.currentJobs--
+func (c *TerminalConfig) appsText() string {
+	names, manifests, _ := c.apps()
+	text := ""
+	for _, name := range names {
+		app := manifests[name]
+		text += fmt.Sprintf("  %s - %s", name, app.Description)
+		if len(app.Tags) > 0 {
+			text += fmt.Sprintf(" [%s]", strings.Join(app.Tags, ", "))
+		}
+		text += "\n"
 	}
-	log.Printf("App finished. Running apps: %d/%d", c.currentJobs, c.MaxConcurrent)
+	return text
 }
 
 func HandleListApps(config *TerminalConfig) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		names, manifests, directory := config.apps()
+		apps := make(map[string]AppInfo, len(names))
+		for _, name := range names {
+			apps[name] = manifests[name].info()
+		}
 		return c.JSON(http.StatusOK, map[string]any{
-			"apps":      config.AllowedApps,
-			"directory": config.AppsDirectory,
+			"apps":      apps,
+			"directory": directory,
 		})
 	}
 }
 
 func GetAppsList(config *TerminalConfig) []string {
-	apps := []string{}
-	for app := range config.AllowedApps {
-		apps = append(apps, app)
-	}
-	return apps
+	names, _, _ := config.apps()
+	return names
 }
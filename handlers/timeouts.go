@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultTimeoutWarning = 30 * time.Second
+	terminateGracePeriod  = 3 * time.Second
+
+	terminatedIdle    = "idle_timeout"
+	terminatedRuntime = "max_runtime"
+)
+
+// AppTimeouts stops apps that sit idle or run too long so they do not hold a
+// job slot forever. Zero values disable the corresponding limit.
+type AppTimeouts struct {
+	Idle       time.Duration `yaml:"idle"`        // no input and no output for this long
+	MaxRuntime time.Duration `yaml:"max_runtime"` // wall-clock limit from launch
+	Warning    time.Duration `yaml:"warning"`     // countdown shown before termination, defaults to 30s
+}
+
+func (t AppTimeouts) next(started, lastActivity, now time.Time) (string, time.Duration) {
+	reason := ""
+	remaining := time.Duration(math.MaxInt64)
+
+	if t.MaxRuntime > 0 {
+		if r := started.Add(t.MaxRuntime).Sub(now); r < remaining {
+			reason, remaining = terminatedRuntime, r
+		}
+	}
+	if t.Idle > 0 {
+		if r := lastActivity.Add(t.Idle).Sub(now); r < remaining {
+			reason, remaining = terminatedIdle, r
+		}
+	}
+	return reason, remaining
+}
+
+func (s *TerminalSession) touch() {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *TerminalSession) watchApp(appName string, cmd *exec.Cmd, timeouts AppTimeouts, exited <-chan struct{}) {
+	if timeouts.Idle <= 0 && timeouts.MaxRuntime <= 0 {
+		return
+	}
+
+	warning := timeouts.Warning
+	if warning <= 0 {
+		warning = defaultTimeoutWarning
+	}
+
+	started := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-exited:
+			return
+		case now = <-ticker.C:
+		}
+
+		s.mu.Lock()
+		lastActivity := s.lastActivity
+		s.mu.Unlock()
+
+		reason, remaining := timeouts.next(started, lastActivity, now)
+		if remaining <= 0 {
+			s.terminateApp(appName, cmd, reason, timeouts, exited)
+			return
+		}
+		if remaining <= warning {
+			s.sendTimeoutWarning(appName, reason, remaining)
+		}
+	}
+}
+
+// sendTimeoutWarning shows a countdown in a banner over the running app.
+func (s *TerminalSession) sendTimeoutWarning(appName, reason string, remaining time.Duration) {
+	seconds := int(math.Ceil(remaining.Seconds()))
+
+	text := fmt.Sprintf(" %s will be closed in %ds for inactivity. Press any key to keep it open. ", appName, seconds)
+	if reason == terminatedRuntime {
+		text = fmt.Sprintf(" %s has reached its time limit and will be closed in %ds. ", appName, seconds)
+	}
+
+	s.sendBanner(text)
+}
+
+// sendBanner draws text over the first row of the screen and puts the cursor
+// back, so full-screen apps are disturbed as little as possible.
+func (s *TerminalSession) sendBanner(text string) {
+	s.sendOutput("\x1b7\x1b[1;1H\x1b[2K\x1b[41;97;1m" + text + "\x1b[0m\x1b8")
+}
+
+func (s *TerminalSession) terminateApp(appName string, cmd *exec.Cmd, reason string, timeouts AppTimeouts, exited <-chan struct{}) {
+	message := fmt.Sprintf("idle for %v", timeouts.Idle)
+	if reason == terminatedRuntime {
+		message = fmt.Sprintf("maximum runtime of %v reached", timeouts.MaxRuntime)
+	}
+
+	s.log.Info("Terminating app", "app", appName, "reason", reason, "detail", message)
+	s.sendOutput(fmt.Sprintf("\r\n[%s terminated: %s]\r\n", appName, message))
+
+	s.mu.Lock()
+	s.stopReason, s.stopMessage = reason, message
+	s.mu.Unlock()
+
+	signalGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(terminateGracePeriod):
+		signalGroup(cmd, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	auditVerificationFailed = "app_verification_failed"
+	auditExecutableChanged  = "app_executable_changed"
+)
+
+// audit records a security-relevant event. Audit lines share the "audit"
+// message so they can be picked out of the server log.
+func audit(logger *slog.Logger, event, appName string, attrs ...any) {
+	logger.Warn("audit", append([]any{"audit_event", event, "app", appName}, attrs...)...)
+}
+
+// verifyExecutable checks the executable at path against the checksum and
+// signature in its manifest and returns its SHA-256 digest. The signature
+// is an ed25519 signature of the raw 32-byte digest by one of keys.
+func verifyExecutable(path string, m AppManifest, keys []ed25519.PublicKey, requireSignature bool) (string, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+	return checkDigest(digest, m, keys, requireSignature)
+}
+
+// checkDigest checks an executable's SHA-256 digest against its manifest and
+// returns it hex encoded.
+func checkDigest(digest []byte, m AppManifest, keys []ed25519.PublicKey, requireSignature bool) (string, error) {
+	sum := hex.EncodeToString(digest)
+
+	if m.SHA256 != "" && !strings.EqualFold(sum, m.SHA256) {
+		return "", fmt.Errorf("checksum mismatch: manifest has %s, executable is %s", m.SHA256, sum)
+	}
+
+	if m.Signature == "" {
+		if requireSignature {
+			return "", errors.New("no signature, and signatures are required")
+		}
+		return sum, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, digest, sig) {
+			return sum, nil
+		}
+	}
+	return "", errors.New("signature does not match any signing key")
+}
+
+func fileDigest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readDigest(file)
+}
+
+func readDigest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyApps pins the digest of every app's executable, dropping apps that
+// fail verification. An app whose executable does not exist yet is kept
+// unless it has a checksum or signature to check, and is verified in full
+// at launch instead.
+func verifyApps(dir string, apps map[string]AppManifest, keys []ed25519.PublicKey, requireSignature bool) map[string]AppManifest {
+	verified := make(map[string]AppManifest, len(apps))
+	for name, manifest := range apps {
+		path := filepath.Join(dir, name)
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) && manifest.SHA256 == "" && manifest.Signature == "" && !requireSignature {
+			verified[name] = manifest
+			continue
+		}
+
+		digest, err := verifyExecutable(path, manifest, keys, requireSignature)
+		if err != nil {
+			audit(slog.Default(), auditVerificationFailed, name, "stage", "registration", "path", path, "reason", err)
+			continue
+		}
+		manifest.digest = digest
+		verified[name] = manifest
+	}
+	return verified
+}
+
+// pinApps holds apps to the digests pinned when they were first registered.
+// An executable that changed since then is audited and keeps its old pin, so
+// it refuses to run until the server restarts, unless the manifest's sha256
+// or signature vouches for the new binary. Pins outlive apps that disappear
+// from the config, so removing and re-adding an app does not reset its pin.
+// It must be called with c.mu held, before apps is published.
+func (c *TerminalConfig) pinApps(apps map[string]AppManifest) {
+	if c.pins == nil {
+		c.pins = make(map[string]string)
+	}
+	for name, manifest := range apps {
+		pinned, ok := c.pins[name]
+		switch {
+		case !ok || manifest.digest == pinned:
+		case manifest.digest != "" && (manifest.SHA256 != "" || manifest.Signature != ""):
+			// verifyApps already checked the new executable against them.
+		default:
+			if manifest.digest != "" {
+				audit(slog.Default(), auditExecutableChanged, name, "stage", "reload",
+					"path", filepath.Join(c.AppsDirectory, name), "registered", pinned, "found", manifest.digest)
+			}
+			manifest.digest = pinned
+			apps[name] = manifest
+		}
+		if manifest.digest != "" {
+			c.pins[name] = manifest.digest
+		}
+	}
+}
+
+// openVerified opens an app's executable right before it is started and
+// verifies what it reads through the returned file. The app must be started
+// from that file with execVerified, so a binary swapped at the path after
+// the check still cannot run.
+func (c *TerminalConfig) openVerified(logger *slog.Logger, appName, path string, m AppManifest) (*os.File, error) {
+	c.mu.Lock()
+	keys, requireSignature := c.SigningKeys, c.RequireSignatures
+	c.mu.Unlock()
+
+	exe, err := os.Open(path)
+	if err != nil {
+		audit(logger, auditVerificationFailed, appName, "stage", "launch", "path", path, "reason", err)
+		return nil, err
+	}
+	if err := verifyOpened(logger, appName, exe, m, keys, requireSignature); err != nil {
+		exe.Close()
+		return nil, err
+	}
+	return exe, nil
+}
+
+func verifyOpened(logger *slog.Logger, appName string, exe *os.File, m AppManifest, keys []ed25519.PublicKey, requireSignature bool) error {
+	path := exe.Name()
+	digest, err := readDigest(exe)
+	if err != nil {
+		audit(logger, auditVerificationFailed, appName, "stage", "launch", "path", path, "reason", err)
+		return err
+	}
+
+	if m.digest == "" {
+		if m.SHA256 == "" && m.Signature == "" && !requireSignature {
+			return nil
+		}
+		if _, err := checkDigest(digest, m, keys, requireSignature); err != nil {
+			audit(logger, auditVerificationFailed, appName, "stage", "launch", "path", path, "reason", err)
+			return err
+		}
+		return nil
+	}
+
+	if sum := hex.EncodeToString(digest); sum != m.digest {
+		audit(logger, auditExecutableChanged, appName, "stage", "launch", "path", path, "registered", m.digest, "found", sum)
+		return errors.New("executable changed since it was registered")
+	}
+	return nil
+}
+
+// appExecutableFD is the descriptor a verified app's executable is passed to
+// it on. The app is run through /proc/self/fd/3 rather than its path; a
+// script's interpreter reopens that path, so the descriptor is inherited.
+const appExecutableFD = 3
+
+// execVerified makes cmd run exe, the file openVerified checked, instead of
+// whatever is at the app's path when it starts. argv[0] keeps the path.
+func execVerified(cmd *exec.Cmd, exe *os.File) {
+	cmd.Path = fmt.Sprintf("/proc/self/fd/%d", appExecutableFD)
+	cmd.ExtraFiles = []*os.File{exe}
+}
+
+func parseSigningKeys(encoded []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(encoded))
+	for _, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("signing_keys: %q is not a base64 ed25519 public key", s)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
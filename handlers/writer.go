@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeQueueLength is how many frames may wait for a connection's writer
+// before senders block.
+const writeQueueLength = 16
+
+// connWriter is the only goroutine that writes to a connection. Sessions
+// queue frames to it instead of writing themselves, so frames go out one at
+// a time and in order, and pings share the same stream. gorilla/websocket
+// allows a single concurrent writer, apart from the control frames its read
+// side answers with.
+type connWriter struct {
+	conn         *websocket.Conn
+	frames       chan outboundFrame
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	log          *slog.Logger
+	stop         chan struct{} // closed to discard what is queued and quit
+	stopOnce     sync.Once
+	done         chan struct{} // closed once the writer has quit
+}
+
+type outboundFrame struct {
+	messageType int
+	data        []byte
+}
+
+func newConnWriter(conn *websocket.Conn, writeTimeout, pingInterval time.Duration, logger *slog.Logger) *connWriter {
+	w := &connWriter{
+		conn:         conn,
+		frames:       make(chan outboundFrame, writeQueueLength),
+		writeTimeout: writeTimeout,
+		pingInterval: pingInterval,
+		log:          logger,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// send queues a frame, waiting while the queue is full. Frames sent after
+// the writer has quit are dropped.
+func (w *connWriter) send(messageType int, data []byte) {
+	select {
+	case w.frames <- outboundFrame{messageType, data}:
+	case <-w.done:
+	}
+}
+
+// close discards whatever is still queued and closes the connection, which
+// also cuts a write in progress short and ends the connection's read loop.
+// It does not wait for the writer to quit.
+func (w *connWriter) close() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		w.conn.Close()
+	})
+}
+
+// closeWith sends a close frame after the frames already queued and waits up
+// to timeout for it to go out before closing the connection.
+func (w *connWriter) closeWith(code int, text string, timeout time.Duration) {
+	deadline := time.After(timeout)
+	select {
+	case w.frames <- outboundFrame{websocket.CloseMessage, websocket.FormatCloseMessage(code, text)}:
+	case <-w.done:
+		return
+	case <-deadline:
+		w.close()
+		return
+	}
+	select {
+	case <-w.done:
+	case <-deadline:
+		w.close()
+	}
+}
+
+func (w *connWriter) run() {
+	defer close(w.done)
+	defer w.conn.Close()
+
+	ping := time.NewTicker(w.pingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-w.stop:
+			return
+		case <-ping.C:
+			err = w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(w.writeTimeout))
+		case frame := <-w.frames:
+			if frame.messageType == websocket.CloseMessage {
+				w.conn.WriteControl(websocket.CloseMessage, frame.data, time.Now().Add(w.writeTimeout))
+				return
+			}
+			w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+			err = w.conn.WriteMessage(frame.messageType, frame.data)
+		}
+		// A client that cannot take a frame in time is disconnected; its read
+		// loop then detaches the session.
+		if err != nil {
+			w.log.Warn("WebSocket write failed", "error", err)
+			return
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cloudsmyth/portfolio-backend/handlers"
 	"github.com/joho/godotenv"
@@ -13,36 +19,69 @@ import (
 )
 
 func main() {
+	handlers.SandboxInit()
 	godotenv.Load()
+	slog.SetDefault(newLogger())
 
-	terminalConfig := &handlers.TerminalConfig{
-		AppsDirectory: "./terminal-apps-exe",
-		AllowedApps: map[string]string{
-			"tradingcardsearch": "Search for trading cards",
-			"testapp":           "App to test if terminal is working when running an app",
-			"kanban":            "Classic kanban style app",
-		},
-		AllowedOrigins: map[string]bool{
-			"http://localhost:5173":       true,
-			"https://spenceralan.dev":     true,
-			"https://www.spenceralan.dev": true,
-		},
-		MaxConcurrent: 1,
+	configPath := os.Getenv("CONFIG_FILE")
+	if configPath == "" {
+		configPath = "config.yaml"
+	}
+
+	terminalConfig, err := handlers.LoadConfig(configPath)
+	if err != nil {
+		slog.Error("Failed to load config", "config", configPath, "error", err)
+		os.Exit(1)
 	}
+	metrics := handlers.NewMetrics(terminalConfig)
+	terminalConfig.Metrics = metrics
+	go handlers.WatchConfig(configPath, terminalConfig, 5*time.Second)
 
 	if err := os.MkdirAll(terminalConfig.AppsDirectory, 0755); err != nil {
-		log.Fatalf("Failed to create apps directory: %v", err)
+		slog.Error("Failed to create apps directory", "dir", terminalConfig.AppsDirectory, "error", err)
+		os.Exit(1)
 	}
 
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	// Request logs and rate limits see the same client address.
+	e.IPExtractor = terminalConfig.ClientIP
 
-	e.Use(middleware.Logger())
+	e.Use(middleware.RequestID())
+	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogRequestID: true,
+		LogMethod:    true,
+		LogStatus:    true,
+		LogLatency:   true,
+		LogRemoteIP:  true,
+		LogError:     true,
+		HandleError:  true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attrs := []slog.Attr{
+				slog.String("request_id", v.RequestID),
+				slog.String("method", v.Method),
+				slog.String("uri", loggedURI(c.Request())),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("remote_ip", v.RemoteIP),
+			}
+			if sessionID, ok := c.Get(handlers.SessionIDKey).(string); ok {
+				attrs = append(attrs, slog.String("session_id", sessionID))
+			}
+			level := slog.LevelInfo
+			if v.Error != nil {
+				level = slog.LevelError
+				attrs = append(attrs, slog.String("error", v.Error.Error()))
+			}
+			slog.LogAttrs(context.Background(), level, "Request", attrs...)
+			return nil
+		},
+	}))
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{
-			"http://localhost:5173",
-			"https://spenceralan.dev",
-			"https://www.spenceralan.dev",
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return terminalConfig.OriginAllowed(origin), nil
 		},
 		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodOptions},
 		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
@@ -52,20 +91,93 @@ func main() {
 	e.GET("/health", handleHealthCheck)
 	e.GET("/apps", handlers.HandleListApps(terminalConfig))
 	e.GET("/ws", handlers.HandleWebSocket(terminalConfig))
-	e.POST("/api/contact", handlers.HandleContact)
+	e.GET("/metrics", handlers.HandleMetrics(metrics))
+	e.POST("/api/contact", handlers.HandleContact(terminalConfig))
+
+	// Recordings hold what visitors saw in their terminals, so they are only
+	// served to callers presenting RECORDINGS_TOKEN as a bearer token.
+	if token := os.Getenv("RECORDINGS_TOKEN"); token != "" {
+		recordings := e.Group("/recordings", middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+		}))
+		recordings.GET("", handlers.HandleListRecordings(terminalConfig))
+		recordings.GET("/:name", handlers.HandleGetRecording(terminalConfig))
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	fmt.Println("Terminal Backend Server")
-	fmt.Println("Apps Directory: ", terminalConfig.AppsDirectory)
-	fmt.Println("Available Apps: ", handlers.GetAppsList(terminalConfig))
-	fmt.Println("Max Concurrent: ", terminalConfig.MaxConcurrent)
-	fmt.Println("Server starting on port:", port)
+	slog.Info("Terminal Backend Server starting",
+		"port", port,
+		"config", configPath,
+		"apps_directory", terminalConfig.AppsDirectory,
+		"apps", handlers.GetAppsList(terminalConfig))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := e.Start(":" + port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(e, terminalConfig)
+}
 
-	e.Logger.Fatal(e.Start(":" + port))
+// shutdown stops accepting connections, lets in-flight HTTP requests such as
+// contact form submissions complete and drains terminal sessions, giving
+// running apps up to ShutdownTimeout to finish.
+func shutdown(e *echo.Echo, terminalConfig *handlers.TerminalConfig) {
+	slog.Info("Shutting down", "timeout", terminalConfig.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), terminalConfig.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		// Hijacked WebSocket connections are not tracked by the HTTP server,
+		// so this only waits for ordinary requests.
+		if err := e.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP requests still running at shutdown", "error", err)
+		}
+	})
+	wg.Go(func() {
+		terminalConfig.Shutdown(ctx)
+	})
+	wg.Wait()
+
+	slog.Info("Shutdown complete")
+}
+
+// newLogger logs JSON lines to stdout at the level named by LOG_LEVEL
+// (debug, info, warn or error), defaulting to info.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			level = slog.LevelInfo
+		}
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+// loggedURI is the request URI with the resume token masked, since the token
+// alone is enough to take over a session.
+func loggedURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("resume") {
+		return r.URL.RequestURI()
+	}
+	query.Set("resume", "REDACTED")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
 }
 
 func handleHome(c echo.Context) error {
@@ -77,6 +189,7 @@ func handleHome(c echo.Context) error {
 			"health":    "/health",
 			"apps":      "/apps",
 			"websocket": "/ws",
+			"metrics":   "/metrics",
 		},
 	})
 }